@@ -0,0 +1,93 @@
+package stan
+
+import (
+	"sync"
+	"time"
+
+	stan "github.com/nats-io/stan.go"
+)
+
+// ackBatcher collects the acks of a manual ack subscription and sends them together
+// once size acks are pending or the window elapsed. Failed acks are redelivered.
+type ackBatcher struct {
+	mu      sync.Mutex
+	size    int
+	pending []*stan.Msg
+	stopped bool
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+func newAckBatcher(window time.Duration, size int) *ackBatcher {
+	a := &ackBatcher{
+		size: size,
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go a.run(window)
+	return a
+}
+
+func (a *ackBatcher) run(window time.Duration) {
+	defer close(a.done)
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flush()
+		case <-a.quit:
+			return
+		}
+	}
+}
+
+// add queues the ack of msg, it is sent immediately once the batcher is stopped
+func (a *ackBatcher) add(msg *stan.Msg) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped {
+		msg.Ack()
+		return
+	}
+	a.pending = append(a.pending, msg)
+	if a.size > 0 && len(a.pending) >= a.size {
+		a.flushLocked()
+	}
+}
+
+func (a *ackBatcher) flush() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.flushLocked()
+}
+
+func (a *ackBatcher) flushLocked() {
+	for _, msg := range a.pending {
+		msg.Ack()
+	}
+	a.pending = nil
+}
+
+// discard drops the pending acks, e.g. of messages received on a lost connection
+func (a *ackBatcher) discard() []*stan.Msg {
+	a.mu.Lock()
+	dropped := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+	return dropped
+}
+
+// stop sends the pending acks, it must be called before the subscription is closed
+func (a *ackBatcher) stop() {
+	a.mu.Lock()
+	if a.stopped {
+		a.mu.Unlock()
+		return
+	}
+	a.stopped = true
+	a.flushLocked()
+	a.mu.Unlock()
+	close(a.quit)
+	<-a.done
+}
@@ -0,0 +1,86 @@
+package stan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+	stan "github.com/nats-io/stan.go"
+)
+
+func TestAckBatch(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan bool, 16)
+	sub, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- e.(*publication).msg.Redelivered
+		return nil
+	}, AckOnSuccess(), AckBatch(100*time.Millisecond, 4), SubscribeOption(stan.AckWait(time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 4 acks fill a batch, the remaining 2 are sent when the window elapsed
+	for i := 0; i < 6; i++ {
+		if err := b.Publish("test", &broker.Message{Body: []byte("msg")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for message")
+		}
+	}
+
+	select {
+	case redelivered := <-ch:
+		t.Errorf("Expected all messages to be acked, got a redelivery (%v)", redelivered)
+	case <-time.After(1500 * time.Millisecond):
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAckBatchFlushOnClose(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, DurableName("batch"))
+	defer b.Disconnect()
+
+	ch := make(chan string, 4)
+	handler := func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}
+	opts := []broker.SubscribeOption{AckOnSuccess(), AckBatch(time.Hour, 100)}
+	sub, err := b.Subscribe("test", handler, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish("test", &broker.Message{Body: []byte("first")})
+	if body := receive(t, ch); body != "first" {
+		t.Fatalf("Expected %q, got %q", "first", body)
+	}
+	// the handler returned, wait for the ack to be queued before closing
+	time.Sleep(100 * time.Millisecond)
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pending ack was sent on close, the resumed durable gets no redelivery
+	if _, err := b.Subscribe("test", handler, opts...); err != nil {
+		t.Fatal(err)
+	}
+	b.Publish("test", &broker.Message{Body: []byte("second")})
+	if body := receive(t, ch); body != "second" {
+		t.Errorf("Expected %q, got redelivered %q", "second", body)
+	}
+}
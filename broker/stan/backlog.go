@@ -0,0 +1,32 @@
+package stan
+
+import (
+	"time"
+
+	stan "github.com/nats-io/stan.go"
+)
+
+// backlog drops replayed messages that fell out of the window while catching up,
+// the first message published after the subscription started ends the replay.
+// stan calls a subscription's callback serially so no locking is needed.
+type backlog struct {
+	window time.Duration
+	start  int64
+	live   bool
+}
+
+func newBacklog(window time.Duration, start time.Time) *backlog {
+	return &backlog{window: window, start: start.UnixNano()}
+}
+
+// stale reports whether msg is a replayed message older than the window
+func (b *backlog) stale(msg *stan.Msg, now time.Time) bool {
+	if b.live {
+		return false
+	}
+	if msg.Timestamp >= b.start {
+		b.live = true
+		return false
+	}
+	return msg.Timestamp < now.Add(-b.window).UnixNano()
+}
@@ -0,0 +1,68 @@
+package stan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+)
+
+func TestBacklog(t *testing.T) {
+	start := time.Now()
+	b := newBacklog(time.Minute, start)
+	msg := func(ts time.Time) *stan.Msg {
+		return &stan.Msg{MsgProto: pb.MsgProto{Timestamp: ts.UnixNano()}}
+	}
+
+	if b.stale(msg(start.Add(-30*time.Second)), start) {
+		t.Error("Expected a message within the window to be replayed")
+	}
+	// catching up took long enough for the next backlog message to leave the window
+	if !b.stale(msg(start.Add(-50*time.Second)), start.Add(20*time.Second)) {
+		t.Error("Expected a message that left the window to be dropped")
+	}
+	if b.stale(msg(start.Add(time.Second)), start.Add(20*time.Second)) {
+		t.Error("Expected a live message to be delivered")
+	}
+	// once live nothing is dropped
+	if b.stale(msg(start.Add(-50*time.Second)), start.Add(20*time.Second)) {
+		t.Error("Expected no message to be dropped once live")
+	}
+}
+
+func TestMaxMessageAge(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	for _, body := range []string{"old", "older"} {
+		if err := b.Publish("test", &broker.Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(1200 * time.Millisecond)
+	if err := b.Publish("test", &broker.Message{Body: []byte("recent")}); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan string, 3)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return e.Ack()
+	}, SubscribeOptions().Durable("durable").DeliverAllAvailable().ManualAck().Build(), MaxMessageAge(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := receive(t, ch); body != "recent" {
+		t.Errorf("Expected only the recent message, got %q", body)
+	}
+	select {
+	case body := <-ch:
+		t.Errorf("Expected the old messages to be skipped, got %q", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,119 @@
+package stan
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+// batcher collects the events of a BatchSubscribe until the batch is full or the
+// wait elapsed and passes them to the handler, batches are handled one at a time
+type batcher struct {
+	b       *stanBroker
+	t       string
+	size    int
+	wait    time.Duration
+	handler func([]broker.Event) error
+
+	mu     sync.Mutex
+	events []broker.Event
+	timer  *time.Timer
+	run    sync.Mutex
+}
+
+// add appends e to the batch, a full batch is handled before add returns
+func (b *batcher) add(e broker.Event) error {
+	b.mu.Lock()
+	b.events = append(b.events, e)
+	if len(b.events) >= b.size {
+		events := b.take()
+		b.mu.Unlock()
+		b.handle(events)
+		return nil
+	}
+	// the wait starts with the first event of a batch
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.wait, b.flush)
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+// take returns the events of the batch and starts a new one, must hold mu
+func (b *batcher) take() []broker.Event {
+	events := b.events
+	b.events = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return events
+}
+
+// flush handles the events collected so far
+func (b *batcher) flush() {
+	b.mu.Lock()
+	events := b.take()
+	b.mu.Unlock()
+	if len(events) > 0 {
+		b.handle(events)
+	}
+}
+
+// handle passes events to the handler and acks all of them if it succeeds, after a
+// failure none is acked so the batch is redelivered
+func (b *batcher) handle(events []broker.Event) {
+	b.run.Lock()
+	defer b.run.Unlock()
+	if err := b.handler(events); err != nil {
+		b.b.logf(log.ErrorLevel, "[stan]: batch handler of %s failed for %d messages: %v", b.t, len(events), err)
+		return
+	}
+	for _, e := range events {
+		if err := e.Ack(); err != nil {
+			b.b.logf(log.WarnLevel, "[stan]: failed to ack batched message of %s: %v", b.t, err)
+		}
+	}
+}
+
+// batchSubscriber hands the pending batch to the handler on Unsubscribe
+type batchSubscriber struct {
+	broker.Subscriber
+	batch *batcher
+}
+
+func (s *batchSubscriber) Unsubscribe() error {
+	s.batch.flush()
+	return s.Subscriber.Unsubscribe()
+}
+
+// BatchSubscribe subscribes to topic in manual ack mode and passes messages to
+// handler in batches of up to maxSize, a smaller batch once maxWait passed since its
+// first message. A batch is acked if the handler succeeds and redelivered after the
+// AckWait if it fails, so maxWait and the handler should take less than the AckWait.
+// With a MaxInflight below maxSize batches are only completed by maxWait.
+func (n *stanBroker) BatchSubscribe(topic string, handler func([]broker.Event) error, maxSize int, maxWait time.Duration, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	if handler == nil {
+		return nil, ErrNilHandler
+	}
+	if maxSize < 1 || maxWait <= 0 {
+		return nil, errors.New("[stan]: batches need a positive size and wait")
+	}
+
+	b := &batcher{
+		b:       n,
+		t:       topic,
+		size:    maxSize,
+		wait:    maxWait,
+		handler: handler,
+	}
+	opts = append(append([]broker.SubscribeOption(nil), opts...), broker.DisableAutoAck())
+	sub, err := n.Subscribe(topic, b.add, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &batchSubscriber{Subscriber: sub, batch: b}, nil
+}
@@ -0,0 +1,67 @@
+package stan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestBatchSubscribe(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	batches := make(chan []string, 4)
+	sub, err := b.BatchSubscribe("test", func(events []broker.Event) error {
+		var bodies []string
+		for _, e := range events {
+			bodies = append(bodies, string(e.Message().Body))
+		}
+		batches <- bodies
+		return nil
+	}, 3, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	publish := func(bodies ...string) {
+		for _, body := range bodies {
+			if err := b.Publish("test", &broker.Message{Body: []byte(body)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	next := func(within time.Duration) []string {
+		select {
+		case batch := <-batches:
+			return batch
+		case <-time.After(within):
+			t.Fatal("Timeout waiting for a batch")
+		}
+		return nil
+	}
+
+	// a full batch doesn't wait
+	start := time.Now()
+	publish("a", "b", "c")
+	if batch := next(5 * time.Second); len(batch) != 3 || batch[0] != "a" || batch[2] != "c" {
+		t.Errorf("Expected the batch [a b c], got %v", batch)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("Expected the full batch before the wait elapsed, got it after %v", elapsed)
+	}
+
+	// a partial batch is handled once the wait elapsed
+	start = time.Now()
+	publish("d", "e")
+	if batch := next(5 * time.Second); len(batch) != 2 || batch[0] != "d" || batch[1] != "e" {
+		t.Errorf("Expected the batch [d e], got %v", batch)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("Expected the partial batch after the wait, got it after %v", elapsed)
+	}
+}
@@ -0,0 +1,135 @@
+package stan
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/micro/go-micro/v2/broker"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+// CheckpointStore persists the sequence of the last message processed per channel
+type CheckpointStore interface {
+	// Load returns the stored sequence of the channel, 0 if there is none
+	Load(channel string) (uint64, error)
+	// Save stores the sequence of the channel
+	Save(channel string, seq uint64) error
+}
+
+type fileCheckpointStore struct {
+	dir string
+}
+
+// NewFileCheckpointStore returns a CheckpointStore keeping one file per channel in dir
+func NewFileCheckpointStore(dir string) CheckpointStore {
+	return &fileCheckpointStore{dir: dir}
+}
+
+func (f *fileCheckpointStore) path(channel string) string {
+	return filepath.Join(f.dir, url.PathEscape(channel))
+}
+
+func (f *fileCheckpointStore) Load(channel string) (uint64, error) {
+	b, err := ioutil.ReadFile(f.path(channel))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// Save writes to a temporary file first so a crash never leaves a partial checkpoint
+func (f *fileCheckpointStore) Save(channel string, seq uint64) error {
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return err
+	}
+	tmp := f.path(channel) + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(seq, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path(channel))
+}
+
+// checkpoint tracks the handled sequences of a subscription. Handlers complete out
+// of order with Workers, the saved sequence only advances over handled messages, a
+// message in progress or due for redelivery holds it back until it was handled.
+type checkpoint struct {
+	sync.Mutex
+	saved   uint64
+	pending map[uint64]struct{}
+	handled map[uint64]struct{}
+}
+
+func newCheckpoint() *checkpoint {
+	return &checkpoint{
+		pending: make(map[uint64]struct{}),
+		handled: make(map[uint64]struct{}),
+	}
+}
+
+func (c *checkpoint) start(seq uint64) {
+	c.Lock()
+	c.pending[seq] = struct{}{}
+	c.Unlock()
+}
+
+// done marks seq handled and calls save with the new checkpoint if it advances, the
+// lock is held so saves are written in order
+func (c *checkpoint) done(seq uint64, save func(uint64)) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.pending, seq)
+	c.handled[seq] = struct{}{}
+
+	floor := ^uint64(0)
+	for s := range c.pending {
+		if s < floor {
+			floor = s
+		}
+	}
+	next := c.saved
+	for s := range c.handled {
+		if s < floor {
+			if s > next {
+				next = s
+			}
+			delete(c.handled, s)
+		}
+	}
+	if next > c.saved {
+		c.saved = next
+		save(next)
+	}
+}
+
+// checkpointHandler saves the sequence below which every message was handled. A
+// failed message keeps the checkpoint back when it is redelivered, i.e. hold is set,
+// permanent failures are acked and count as handled.
+func (n *stanBroker) checkpointHandler(store CheckpointStore, hold bool, h broker.Handler) broker.Handler {
+	c := newCheckpoint()
+	return func(e broker.Event) error {
+		p, ok := e.(*publication)
+		if !ok || p.msg == nil {
+			return h(e)
+		}
+		seq := p.msg.Sequence
+		c.start(seq)
+		err := h(e)
+		if err != nil && hold && !isPermanent(err) {
+			return err
+		}
+		c.done(seq, func(seq uint64) {
+			if err := store.Save(p.t, seq); err != nil {
+				n.logf(log.ErrorLevel, "[stan]: failed to save checkpoint of %s: %v", p.t, err)
+			}
+		})
+		return err
+	}
+}
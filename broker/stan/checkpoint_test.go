@@ -0,0 +1,88 @@
+package stan
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/micro/go-micro/v2/broker"
+	"github.com/micro/go-micro/v2/logger"
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileCheckpointStore(dir)
+	if seq, err := store.Load("orders/eu"); err != nil || seq != 0 {
+		t.Fatalf("Expected no checkpoint, got %d, %v", seq, err)
+	}
+	for _, seq := range []uint64{1, 42} {
+		if err := store.Save("orders/eu", seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seq, err := NewFileCheckpointStore(dir).Load("orders/eu"); err != nil || seq != 42 {
+		t.Errorf("Expected checkpoint 42, got %d, %v", seq, err)
+	}
+}
+
+type failingCheckpointStore struct{}
+
+func (failingCheckpointStore) Load(string) (uint64, error) { return 0, nil }
+
+func (failingCheckpointStore) Save(string, uint64) error { return errors.New("disk full") }
+
+func TestCheckpointSaveErrorLogged(t *testing.T) {
+	l := newCaptureLogger()
+	b := NewBroker(Logger(l)).(*stanBroker)
+
+	h := b.checkpointHandler(failingCheckpointStore{}, false, func(broker.Event) error { return nil })
+	if err := h(&publication{t: "test", msg: &stan.Msg{MsgProto: pb.MsgProto{Sequence: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if len(l.levels) != 1 || l.levels[0] != logger.ErrorLevel {
+		t.Errorf("Expected the save error logged through the broker logger, got %v", l.levels)
+	}
+}
+
+func TestCheckpointMonotonic(t *testing.T) {
+	c := newCheckpoint()
+	var saved []uint64
+	save := func(seq uint64) { saved = append(saved, seq) }
+
+	for seq := uint64(1); seq <= 4; seq++ {
+		c.start(seq)
+	}
+	// out of order completions wait for the messages before them
+	c.done(3, save)
+	c.done(2, save)
+	if len(saved) != 0 {
+		t.Fatalf("Expected no checkpoint while 1 is in progress, got %v", saved)
+	}
+	c.done(1, save)
+	// 4 is still in progress, e.g. timed out and due for redelivery
+	c.start(5)
+	c.done(5, save)
+	c.done(4, save)
+	if want := "[3 5]"; fmt.Sprint(saved) != want {
+		t.Errorf("Expected checkpoints %s, got %v", want, saved)
+	}
+
+	// a redelivered old message doesn't move it backwards
+	c.start(2)
+	c.done(2, save)
+	if want := "[3 5]"; fmt.Sprint(saved) != want {
+		t.Errorf("Expected checkpoints %s, got %v", want, saved)
+	}
+}
@@ -0,0 +1,72 @@
+package stan
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+// ErrCircuitOpen is returned by Publish while the circuit breaker is open
+var ErrCircuitOpen = errors.New("[stan]: circuit open")
+
+// circuit opens after a number of consecutive publish failures, once the reset
+// window elapsed a single trial publish decides whether it closes again
+type circuit struct {
+	sync.Mutex
+	failures int
+	reset    time.Duration
+	count    int
+	opened   time.Time
+	trial    bool
+}
+
+func newCircuit(failures int, reset time.Duration) *circuit {
+	return &circuit{failures: failures, reset: reset}
+}
+
+// allow reports whether a publish may be attempted and whether it is the trial
+func (c *circuit) allow() (ok, trial bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.count < c.failures {
+		return true, false
+	}
+	if c.trial || time.Since(c.opened) < c.reset {
+		return false, false
+	}
+	// half open
+	c.trial = true
+	return true, true
+}
+
+// done records the result of an allowed publish, only the trial itself ends the
+// half open state
+func (c *circuit) done(err error, trial bool) {
+	c.Lock()
+	defer c.Unlock()
+	if trial {
+		c.trial = false
+	}
+	if err == nil {
+		c.count = 0
+		return
+	}
+	c.count++
+	if c.count >= c.failures {
+		c.opened = time.Now()
+	}
+}
+
+func (c *circuit) wrap(fn PublishFunc) PublishFunc {
+	return func(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+		ok, trial := c.allow()
+		if !ok {
+			return ErrCircuitOpen
+		}
+		err := fn(topic, msg, opts...)
+		c.done(err, trial)
+		return err
+	}
+}
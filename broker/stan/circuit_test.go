@@ -0,0 +1,77 @@
+package stan
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestCircuit(t *testing.T) {
+	fail := errors.New("publish failed")
+	var calls int
+	var err error
+	fn := newCircuit(2, 100*time.Millisecond).wrap(func(string, *broker.Message, ...broker.PublishOption) error {
+		calls++
+		return err
+	})
+
+	err = fail
+	for i := 0; i < 2; i++ {
+		if got := fn("test", &broker.Message{}); got != fail {
+			t.Fatalf("Expected publish error, got %v", got)
+		}
+	}
+	if got := fn("test", &broker.Message{}); got != ErrCircuitOpen {
+		t.Fatalf("Expected ErrCircuitOpen, got %v", got)
+	}
+	if calls != 2 {
+		t.Errorf("Expected an open circuit to skip the publish, got %d calls", calls)
+	}
+
+	// a failed trial opens the circuit again
+	time.Sleep(150 * time.Millisecond)
+	if got := fn("test", &broker.Message{}); got != fail {
+		t.Fatalf("Expected the trial publish to run, got %v", got)
+	}
+	if got := fn("test", &broker.Message{}); got != ErrCircuitOpen {
+		t.Fatalf("Expected ErrCircuitOpen after a failed trial, got %v", got)
+	}
+
+	// a successful trial closes it
+	time.Sleep(150 * time.Millisecond)
+	err = nil
+	for i := 0; i < 3; i++ {
+		if got := fn("test", &broker.Message{}); got != nil {
+			t.Fatalf("Expected a closed circuit, got %v", got)
+		}
+	}
+}
+
+func TestCircuitSingleTrial(t *testing.T) {
+	fail := errors.New("publish failed")
+	c := newCircuit(1, 50*time.Millisecond)
+
+	// a publish started while closed is still in flight when the circuit opens
+	if ok, _ := c.allow(); !ok {
+		t.Fatal("Expected a closed circuit")
+	}
+	c.done(fail, false)
+	time.Sleep(100 * time.Millisecond)
+
+	if ok, trial := c.allow(); !ok || !trial {
+		t.Fatal("Expected the trial publish to be allowed")
+	}
+	// a straggler finishing during the trial doesn't let another one through
+	c.done(fail, false)
+	time.Sleep(100 * time.Millisecond)
+	if ok, _ := c.allow(); ok {
+		t.Error("Expected a single trial while half open")
+	}
+
+	c.done(nil, true)
+	if ok, _ := c.allow(); !ok {
+		t.Error("Expected the trial to close the circuit")
+	}
+}
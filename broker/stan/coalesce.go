@@ -0,0 +1,79 @@
+package stan
+
+import (
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+// coalescer sends only the latest publish per topic once per window
+type coalescer struct {
+	sync.Mutex
+	window  time.Duration
+	pending map[string]*coalesced
+	logf    func(level log.Level, format string, v ...interface{})
+}
+
+type coalesced struct {
+	fn    PublishFunc
+	msg   *broker.Message
+	opts  []broker.PublishOption
+	timer *time.Timer
+}
+
+func newCoalescer(window time.Duration, logf func(level log.Level, format string, v ...interface{})) *coalescer {
+	return &coalescer{
+		window:  window,
+		pending: make(map[string]*coalesced),
+		logf:    logf,
+	}
+}
+
+// wrap buffers publishes, replacing the pending message of the topic
+func (c *coalescer) wrap(fn PublishFunc) PublishFunc {
+	return func(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+		c.Lock()
+		defer c.Unlock()
+		if p, ok := c.pending[topic]; ok {
+			p.fn, p.msg, p.opts = fn, msg, opts
+			return nil
+		}
+		p := &coalesced{fn: fn, msg: msg, opts: opts}
+		p.timer = time.AfterFunc(c.window, func() { c.send(topic, p) })
+		c.pending[topic] = p
+		return nil
+	}
+}
+
+// send publishes the pending message of topic unless it was flushed already
+func (c *coalescer) send(topic string, p *coalesced) {
+	c.Lock()
+	if c.pending[topic] != p {
+		c.Unlock()
+		return
+	}
+	delete(c.pending, topic)
+	fn, msg, opts := p.fn, p.msg, p.opts
+	c.Unlock()
+
+	if err := fn(topic, msg, opts...); err != nil {
+		c.logf(log.ErrorLevel, "[stan]: failed to publish coalesced message to %s: %v", topic, err)
+	}
+}
+
+// flush publishes every pending message now
+func (c *coalescer) flush() {
+	c.Lock()
+	pending := c.pending
+	c.pending = make(map[string]*coalesced)
+	c.Unlock()
+
+	for topic, p := range pending {
+		p.timer.Stop()
+		if err := p.fn(topic, p.msg, p.opts...); err != nil {
+			c.logf(log.ErrorLevel, "[stan]: failed to publish coalesced message to %s: %v", topic, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package stan
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestCoalescePublish(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, CoalescePublish(100*time.Millisecond))
+	defer b.Disconnect()
+
+	ch := make(chan string, 20)
+	if _, err := b.Subscribe("state", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 10; i++ {
+		if err := b.Publish("state", &broker.Message{Body: []byte(fmt.Sprintf("%d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if body := receive(t, ch); body != "10" {
+		t.Errorf("Expected only the latest value, got %s", body)
+	}
+
+	// the next window sends its own latest value
+	if err := b.Publish("state", &broker.Message{Body: []byte("11")}); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, ch); body != "11" {
+		t.Errorf("Expected the value of the next window, got %s", body)
+	}
+
+	select {
+	case body := <-ch:
+		t.Errorf("Expected intermediate values to be dropped, got %s", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,91 @@
+package stan
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+// compactIdle is how long the replay may be idle before the compacted batch is delivered
+const compactIdle = 200 * time.Millisecond
+
+// compactor buffers replayed publications keeping only the latest per key
+type compactor struct {
+	sync.Mutex
+	key     func(*broker.Message) string
+	start   int64
+	manual  bool
+	deliver func(*publication)
+	latest  map[string]*publication
+	timer   *time.Timer
+	live    bool
+}
+
+func newCompactor(key func(*broker.Message) string, start int64, manual bool, deliver func(*publication)) *compactor {
+	return &compactor{
+		key:     key,
+		start:   start,
+		manual:  manual,
+		deliver: deliver,
+		latest:  make(map[string]*publication),
+	}
+}
+
+// handle buffers replayed publications and passes live ones through
+func (c *compactor) handle(p *publication) {
+	c.Lock()
+	if c.live || p.msg.Timestamp >= c.start {
+		c.flush()
+		c.Unlock()
+		c.deliver(p)
+		return
+	}
+
+	k := c.key(p.m)
+	if prev, ok := c.latest[k]; ok && c.manual {
+		// superseded, ack it so it isn't redelivered
+		prev.Ack()
+	}
+	c.latest[k] = p
+
+	if c.timer == nil {
+		c.timer = time.AfterFunc(compactIdle, c.idle)
+	} else {
+		c.timer.Reset(compactIdle)
+	}
+	c.Unlock()
+}
+
+// idle delivers the compacted batch once the replay has gone quiet
+func (c *compactor) idle() {
+	c.Lock()
+	c.flush()
+	c.Unlock()
+}
+
+// flush delivers buffered publications in sequence order and switches to live delivery,
+// it must be called with the lock held so live messages wait for the batch
+func (c *compactor) flush() {
+	if c.live {
+		return
+	}
+	c.live = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+
+	ps := make([]*publication, 0, len(c.latest))
+	for _, p := range c.latest {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].msg.Sequence < ps[j].msg.Sequence
+	})
+	c.latest = nil
+
+	for _, p := range ps {
+		c.deliver(p)
+	}
+}
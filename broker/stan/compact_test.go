@@ -0,0 +1,103 @@
+package stan
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestLatestPerKey(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	updates := [][2]string{
+		{"a", "a1"},
+		{"b", "b1"},
+		{"a", "a2"},
+		{"b", "b2"},
+		{"a", "a3"},
+	}
+	for _, u := range updates {
+		msg := &broker.Message{Header: map[string]string{"key": u[0]}, Body: []byte(u[1])}
+		if err := b.Publish("test", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ch := make(chan string, 10)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	},
+		SubscribeOptions().DeliverAllAvailable().Build(),
+		LatestPerKey(func(m *broker.Message) string { return m.Header["key"] }),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"b2", "a3"} {
+		if body := receive(t, ch); body != expected {
+			t.Errorf("Expected %q, got %q", expected, body)
+		}
+	}
+
+	// live messages are passed through
+	if err := b.Publish("test", &broker.Message{Header: map[string]string{"key": "a"}, Body: []byte("a4")}); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, ch); body != "a4" {
+		t.Errorf("Expected %q, got %q", "a4", body)
+	}
+}
+
+func TestLatestPerKeyAcksAfterDelivery(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	for _, body := range []string{"a1", "a2"} {
+		if err := b.Publish("test", &broker.Message{Header: map[string]string{"key": "a"}, Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub, err := b.Subscribe("test", func(e broker.Event) error {
+		return nil
+	},
+		SubscribeOptions().Durable("compact").DeliverAllAvailable().Build(),
+		LatestPerKey(func(m *broker.Message) string { return m.Header["key"] }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// close while the latest message is still buffered
+	s := sub.(*subscriber)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&s.received) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * compactIdle)
+
+	// the buffered message wasn't acked, the superseded one was
+	ch := make(chan string, 2)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, SubscribeOptions().Durable("compact").Build()); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, ch); body != "a2" {
+		t.Errorf("Expected the buffered message to be redelivered, got %q", body)
+	}
+}
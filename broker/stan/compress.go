@@ -0,0 +1,56 @@
+package stan
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+)
+
+// flag byte prefixing payloads when compression is enabled
+const (
+	payloadRaw byte = iota
+	payloadGzip
+)
+
+var errUnknownPayloadFlag = errors.New("[stan]: unknown payload compression flag")
+
+// compress gzips data larger than threshold, prefixing the payload with its flag
+func compress(data []byte, threshold int) ([]byte, error) {
+	if len(data) <= threshold {
+		b := make([]byte, 0, len(data)+1)
+		b = append(b, payloadRaw)
+		return append(b, data...), nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(payloadGzip)
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress reverses compress based on the payload flag
+func decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errUnknownPayloadFlag
+	}
+	switch data[0] {
+	case payloadRaw:
+		return data[1:], nil
+	case payloadGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	default:
+		return nil, errUnknownPayloadFlag
+	}
+}
@@ -0,0 +1,76 @@
+package stan
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+	stan "github.com/nats-io/stan.go"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	small := []byte("small")
+	large := []byte(strings.Repeat("large payload ", 100))
+
+	for _, data := range [][]byte{small, large} {
+		b, err := compress(data, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := decompress(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("Expected %q, got %q", data, out)
+		}
+	}
+}
+
+func TestCompressThreshold(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, CompressThreshold(64))
+	defer b.Disconnect()
+
+	flags := make(chan byte, 2)
+	if _, err := b.conn.Subscribe("test", func(msg *stan.Msg) {
+		flags <- msg.Data[0]
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := make(chan string, 2)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		bodies <- string(e.Message().Body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	large := strings.Repeat("large payload ", 100)
+	for _, body := range []string{"small", large} {
+		if err := b.Publish("test", &broker.Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range []byte{payloadRaw, payloadGzip} {
+		select {
+		case flag := <-flags:
+			if flag != expected {
+				t.Errorf("Expected payload flag %d, got %d", expected, flag)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for raw message")
+		}
+	}
+	for _, expected := range []string{"small", large} {
+		if body := receive(t, bodies); body != expected {
+			t.Errorf("Expected %q, got %q", expected, body)
+		}
+	}
+}
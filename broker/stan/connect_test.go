@@ -0,0 +1,262 @@
+package stan
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+	nats "github.com/nats-io/nats.go"
+	stan "github.com/nats-io/stan.go"
+)
+
+// fakeConn is a streaming connection that doesn't talk to a server
+type fakeConn struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *fakeConn) Publish(string, []byte) error {
+	return nil
+}
+
+func (c *fakeConn) PublishAsync(string, []byte, stan.AckHandler) (string, error) {
+	return "", nil
+}
+
+func (c *fakeConn) Subscribe(string, stan.MsgHandler, ...stan.SubscriptionOption) (stan.Subscription, error) {
+	return nil, errors.New("fake connection can't subscribe")
+}
+
+func (c *fakeConn) QueueSubscribe(string, string, stan.MsgHandler, ...stan.SubscriptionOption) (stan.Subscription, error) {
+	return nil, errors.New("fake connection can't subscribe")
+}
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *fakeConn) NatsConn() *nats.Conn {
+	return nil
+}
+
+// fakeConnector fails connect attempts with errs in turn, later attempts connect
+// to a fakeConn, or fail with err if it's set
+type fakeConnector struct {
+	mu       sync.Mutex
+	errs     []error
+	err      error
+	attempts int
+	conns    []*fakeConn
+}
+
+func (f *fakeConnector) connect(url, clusterID, clientID string, natsOpts []nats.Option, opts []stan.Option) (stan.Conn, *nats.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, nil, err
+	}
+	if f.err != nil {
+		return nil, nil, f.err
+	}
+	c := &fakeConn{}
+	f.conns = append(f.conns, c)
+	return c, nil, nil
+}
+
+func (f *fakeConnector) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.attempts
+}
+
+// newFakeConnectBroker returns a broker dialing with f instead of a server
+func newFakeConnectBroker(f *fakeConnector, opts ...broker.Option) *stanBroker {
+	opts = append([]broker.Option{ClusterID(testClusterID)}, opts...)
+	b := NewBroker(opts...).(*stanBroker)
+	b.connectFn = f.connect
+	return b
+}
+
+func TestConnectRetriesTransientErrors(t *testing.T) {
+	f := &fakeConnector{errs: []error{nats.ErrNoServers, nats.ErrNoServers}}
+	b := newFakeConnectBroker(f, ConnectTimeout(5*time.Second))
+	defer b.Disconnect()
+
+	start := time.Now()
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count(); n != 3 {
+		t.Errorf("Expected 3 attempts, got %d", n)
+	}
+	// attempts after the first one are a second apart
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Errorf("Expected the retries to wait between attempts, connected after %v", elapsed)
+	}
+	if !b.Ready() {
+		t.Error("Expected the broker to be ready")
+	}
+}
+
+func TestReconnectRetriesTransientErrors(t *testing.T) {
+	f := &fakeConnector{}
+	b := newFakeConnectBroker(f, ConnectRetry(true))
+	defer b.Disconnect()
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	lost := f.conns[0]
+	f.errs = []error{nats.ErrNoServers}
+	f.mu.Unlock()
+
+	// the reconnect retries until the factory connects again
+	b.connectionLost(lost, errors.New("connection lost"))
+
+	if n := f.count(); n != 3 {
+		t.Errorf("Expected a failed and a successful reconnect attempt, got %d attempts", n)
+	}
+	b.RLock()
+	conn := b.conn
+	b.RUnlock()
+	if conn == stan.Conn(lost) || conn == nil {
+		t.Error("Expected the lost connection to be replaced")
+	}
+	if !b.Ready() {
+		t.Error("Expected the broker to be ready after the reconnect")
+	}
+}
+
+func TestInitWhileConnecting(t *testing.T) {
+	f := &fakeConnector{err: nats.ErrNoServers}
+	b := newFakeConnectBroker(f, ConnectTimeout(10*time.Second))
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.Connect()
+	}()
+
+	// wait for the connect loop to retry
+	for start := time.Now(); f.count() < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Timeout waiting for the connect loop")
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if err := b.Init(broker.Addrs("127.0.0.1:1")); err == nil {
+			t.Fatal("Expected Init to fail while connecting")
+		}
+	}
+
+	b.Disconnect()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Expected the disconnected connect loop to return nil, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the connect loop to return")
+	}
+	if err := b.Init(broker.Addrs("127.0.0.1:1")); err != nil {
+		t.Errorf("Expected Init to succeed after the connect returned, got %v", err)
+	}
+}
+
+func TestOnPingFailure(t *testing.T) {
+	var pingErrs []error
+	f := &fakeConnector{}
+	b := newFakeConnectBroker(f, OnPingFailure(func(err error) {
+		pingErrs = append(pingErrs, err)
+	}))
+	defer b.Disconnect()
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a closed connection isn't a ping failure
+	b.connectionLost(f.conns[0], stan.ErrConnectionClosed)
+	if len(pingErrs) != 0 {
+		t.Fatalf("Expected no ping failure for a closed connection, got %v", pingErrs)
+	}
+
+	b.connectionLost(f.conns[0], stan.ErrMaxPings)
+	if len(pingErrs) != 1 || pingErrs[0] != stan.ErrMaxPings {
+		t.Errorf("Expected the ping failure to be reported, got %v", pingErrs)
+	}
+}
+
+func TestWaitReconnect(t *testing.T) {
+	f := &fakeConnector{}
+	b := newFakeConnectBroker(f, ConnectRetry(true))
+	defer b.Disconnect()
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing reconnects without a lost connection
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := b.WaitReconnect(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// the first attempt fails so the reconnect completes after the wait started
+	f.mu.Lock()
+	lost := f.conns[0]
+	f.errs = []error{nats.ErrNoServers}
+	f.mu.Unlock()
+	go b.connectionLost(lost, errors.New("connection lost"))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.WaitReconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Ready() {
+		t.Error("Expected the broker to be ready once the reconnect completed")
+	}
+}
+
+func TestReconnectGivingUpEmitsDisconnected(t *testing.T) {
+	f := &fakeConnector{}
+	b := newFakeConnectBroker(f, ConnectRetry(true), ConnectTimeout(1500*time.Millisecond))
+	defer b.Disconnect()
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	ch := b.StateChanges()
+
+	f.mu.Lock()
+	lost := f.conns[0]
+	f.err = nats.ErrNoServers
+	f.mu.Unlock()
+	b.connectionLost(lost, errors.New("connection lost"))
+
+	var states []string
+	for len(states) < 3 {
+		select {
+		case s := <-ch:
+			states = append(states, s.String())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for states, got %v", states)
+		}
+	}
+	if got := strings.Join(states, ","); got != "disconnected,reconnecting,disconnected" {
+		t.Errorf("Expected disconnected,reconnecting,disconnected, got %s", got)
+	}
+}
@@ -0,0 +1,53 @@
+package stan
+
+import (
+	"errors"
+	"strings"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ConnectError is returned by Connect when an attempt fails with an error retrying
+// won't fix, e.g. a rejected authorization. Connect fails right away instead of
+// retrying until the timeout.
+type ConnectError struct {
+	Err error
+}
+
+func (e *ConnectError) Error() string {
+	return "[stan]: permanent connect error: " + e.Err.Error()
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// permanentConnectErrors are the nats errors of a misconfigured client or server
+var permanentConnectErrors = []error{
+	nats.ErrAuthorization,
+	nats.ErrAuthExpired,
+	nats.ErrSecureConnRequired,
+	nats.ErrSecureConnWanted,
+	nats.ErrMultipleTLSConfigs,
+	nats.ErrNoEchoNotSupported,
+	nats.ErrUserButNoSigCB,
+	nats.ErrNkeyButNoSigCB,
+	nats.ErrNkeyAndUser,
+	nats.ErrNkeysNotSupported,
+	nats.ErrTokenAlreadySet,
+}
+
+// isPermanentConnectError reports whether a failed connect attempt is futile to
+// retry. An unknown cluster id can't be told apart from a streaming server that
+// isn't up yet, both time out, so it is retried.
+func isPermanentConnectError(err error) bool {
+	// nats returns errors received while connecting as new errors with the same text
+	msg := strings.ToLower(err.Error())
+	for _, perr := range permanentConnectErrors {
+		if errors.Is(err, perr) || strings.HasPrefix(msg, perr.Error()) {
+			return true
+		}
+	}
+	// rejected by the streaming server
+	return strings.Contains(msg, "invalid clientid")
+}
@@ -0,0 +1,41 @@
+package stan
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+func TestConnectPermanentError(t *testing.T) {
+	f := &fakeConnector{err: nats.ErrAuthorization}
+	b := newFakeConnectBroker(f, ConnectTimeout(5*time.Second))
+
+	start := time.Now()
+	err := b.Connect()
+	var cerr *ConnectError
+	if !errors.As(err, &cerr) || !errors.Is(err, nats.ErrAuthorization) {
+		t.Fatalf("Expected a ConnectError wrapping %v, got %v", nats.ErrAuthorization, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected connect to abort right away, took %v", elapsed)
+	}
+	if n := f.count(); n != 1 {
+		t.Errorf("Expected a single attempt, got %d", n)
+	}
+}
+
+func TestConnectTransientError(t *testing.T) {
+	f := &fakeConnector{err: nats.ErrNoServers}
+	b := newFakeConnectBroker(f, ConnectTimeout(1500*time.Millisecond))
+
+	err := b.Connect()
+	var cerr *ConnectError
+	if err == nil || errors.As(err, &cerr) {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if n := f.count(); n < 2 {
+		t.Errorf("Expected transient errors to be retried, got %d attempts", n)
+	}
+}
@@ -0,0 +1,73 @@
+package stan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	log "github.com/micro/go-micro/v2/logger"
+	nats "github.com/nats-io/nats.go"
+)
+
+// RotateCredentials reconnects with the nats credentials file at path, e.g. after
+// the file was renewed. The connection is closed before connecting again so the
+// server accepts the client id, tracked subscriptions are resubscribed as on a
+// reconnect. Messages aren't delivered and publishes fail while reconnecting. If
+// connecting with the new credentials fails the broker reconnects with the previous
+// ones and returns the error.
+func (n *stanBroker) RotateCredentials(path string) error {
+	// fail early on a file that doesn't hold credentials
+	var creds nats.Options
+	if err := nats.UserCredentials(path)(&creds); err != nil {
+		return err
+	}
+	if _, err := creds.UserJWT(); err != nil {
+		return err
+	}
+	if _, err := creds.SignatureCB([]byte("nonce")); err != nil {
+		return err
+	}
+
+	if !atomic.CompareAndSwapInt32(&n.reconnecting, 0, 1) {
+		return errors.New("[stan]: reconnect in progress")
+	}
+	defer atomic.StoreInt32(&n.reconnecting, 0)
+	defer n.startConnect()()
+
+	n.Lock()
+	if n.conn == nil {
+		n.Unlock()
+		return errors.New("not connected")
+	}
+	// the credentials apply to the nats connection owned by the broker
+	if n.natsOpts == nil {
+		n.Unlock()
+		return errors.New("[stan]: can't rotate the credentials of a custom nats connection")
+	}
+	conn := n.conn
+	prev := n.credentials
+	n.conn = nil
+	n.credentials = path
+	n.Unlock()
+
+	n.setReady(false)
+	n.states.emit(Reconnecting)
+	if err := conn.Close(); err != nil {
+		n.logf(log.WarnLevel, "[stan]: failed to close connection for credential rotation: %v", err)
+	}
+
+	err := n.connect(context.Background())
+	if err != nil {
+		n.logf(log.ErrorLevel, "[stan]: failed to connect with rotated credentials: %v", err)
+		n.Lock()
+		n.credentials = prev
+		n.Unlock()
+		if rerr := n.connect(context.Background()); rerr != nil {
+			return fmt.Errorf("[stan]: credential rotation failed: %v, reconnect failed: %v", err, rerr)
+		}
+	}
+	n.resubscribe()
+	n.states.reconnect()
+	return err
+}
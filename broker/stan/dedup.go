@@ -0,0 +1,83 @@
+package stan
+
+import (
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+// MessageIDHeader identifies a message for DeduplicatePublish
+const MessageIDHeader = "Micro-Message-ID"
+
+// deduplicator skips publishes of message ids published within the window, it
+// remembers up to size ids
+type deduplicator struct {
+	sync.Mutex
+	window time.Duration
+	size   int
+	seen   map[string]time.Time
+	// ids in publish order for evicting the oldest
+	order []dedupEntry
+}
+
+type dedupEntry struct {
+	id string
+	at time.Time
+}
+
+func newDeduplicator(window time.Duration, size int) *deduplicator {
+	return &deduplicator{
+		window: window,
+		size:   size,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// reserve records id and reports whether it wasn't published within the window
+func (d *deduplicator) reserve(id string, now time.Time) bool {
+	d.Lock()
+	defer d.Unlock()
+	if at, ok := d.seen[id]; ok && now.Sub(at) < d.window {
+		return false
+	}
+	d.seen[id] = now
+	d.order = append(d.order, dedupEntry{id: id, at: now})
+	for len(d.seen) > d.size || (len(d.order) > 0 && now.Sub(d.order[0].at) >= d.window) {
+		e := d.order[0]
+		d.order = d.order[1:]
+		// a released or republished id has a different entry
+		if at, ok := d.seen[e.id]; ok && at.Equal(e.at) {
+			delete(d.seen, e.id)
+		}
+	}
+	return true
+}
+
+// release forgets id after its publish failed so a retry is published
+func (d *deduplicator) release(id string, at time.Time) {
+	d.Lock()
+	if seen, ok := d.seen[id]; ok && seen.Equal(at) {
+		delete(d.seen, id)
+	}
+	d.Unlock()
+}
+
+// wrap skips publishes of messages with an id published within the window
+func (d *deduplicator) wrap(fn PublishFunc) PublishFunc {
+	return func(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+		id := msg.Header[MessageIDHeader]
+		if len(id) == 0 {
+			return fn(topic, msg, opts...)
+		}
+		now := time.Now()
+		if !d.reserve(id, now) {
+			return nil
+		}
+		if err := fn(topic, msg, opts...); err != nil {
+			d.release(id, now)
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,68 @@
+package stan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestDeduplicator(t *testing.T) {
+	d := newDeduplicator(time.Minute, 2)
+	now := time.Now()
+
+	if !d.reserve("a", now) || d.reserve("a", now.Add(time.Second)) {
+		t.Error("Expected a repeated id within the window to be a duplicate")
+	}
+	if !d.reserve("a", now.Add(time.Minute)) {
+		t.Error("Expected an id to be published again after the window")
+	}
+
+	// the oldest id is evicted beyond the size
+	d.reserve("b", now.Add(time.Minute))
+	d.reserve("c", now.Add(time.Minute))
+	if !d.reserve("a", now.Add(time.Minute)) {
+		t.Error("Expected the evicted id to be published again")
+	}
+
+	// a failed publish is forgotten
+	at := now.Add(2 * time.Minute)
+	d.reserve("d", at)
+	d.release("d", at)
+	if !d.reserve("d", at) {
+		t.Error("Expected a released id to be published again")
+	}
+}
+
+func TestDeduplicatePublish(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, DeduplicatePublish(time.Minute, 100))
+	defer b.Disconnect()
+
+	ch := make(chan string, 3)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"first", "retry"} {
+		msg := &broker.Message{Header: map[string]string{MessageIDHeader: "id-1"}, Body: []byte(body)}
+		if err := b.Publish("test", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("other")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := receive(t, ch); body != "first" {
+		t.Errorf("Expected %q, got %q", "first", body)
+	}
+	if body := receive(t, ch); body != "other" {
+		t.Errorf("Expected the duplicate to be skipped, got %q", body)
+	}
+}
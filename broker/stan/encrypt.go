@@ -0,0 +1,58 @@
+package stan
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// encryptionVersion prefixes every encrypted payload so the format or key
+// can be rotated without breaking consumers of older messages
+const encryptionVersion byte = 1
+
+var (
+	errUnknownEncryptionVersion = errors.New("[stan]: unknown encryption version")
+	errEncryptedPayloadTooShort = errors.New("[stan]: encrypted payload too short")
+)
+
+// newAEAD returns the cipher for the given key and algorithm
+func newAEAD(key []byte, algo string) (cipher.AEAD, error) {
+	switch strings.ToLower(algo) {
+	case "", "aes-gcm":
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, fmt.Errorf("[stan]: unsupported encryption algorithm %q", algo)
+	}
+}
+
+// encrypt seals data as version | nonce | ciphertext
+func encrypt(aead cipher.AEAD, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, 1+len(nonce)+len(data)+aead.Overhead())
+	b = append(b, encryptionVersion)
+	b = append(b, nonce...)
+	return aead.Seal(b, nonce, data, nil), nil
+}
+
+// decrypt opens data sealed by encrypt
+func decrypt(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < 1+aead.NonceSize() {
+		return nil, errEncryptedPayloadTooShort
+	}
+	if data[0] != encryptionVersion {
+		return nil, errUnknownEncryptionVersion
+	}
+	nonce := data[1 : 1+aead.NonceSize()]
+	return aead.Open(nil, nonce, data[1+aead.NonceSize():], nil)
+}
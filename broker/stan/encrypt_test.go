@@ -0,0 +1,94 @@
+package stan
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+var (
+	testKey  = []byte("0123456789abcdef0123456789abcdef")
+	wrongKey = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func TestEncryptRoundTrip(t *testing.T) {
+	aead, err := newAEAD(testKey, "aes-gcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("secret payload")
+
+	b, err := encrypt(aead, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != encryptionVersion {
+		t.Errorf("Expected version prefix %d, got %d", encryptionVersion, b[0])
+	}
+	if bytes.Contains(b, data) {
+		t.Error("Expected payload to be encrypted")
+	}
+
+	out, err := decrypt(aead, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("Expected %q, got %q", data, out)
+	}
+
+	other, err := newAEAD(wrongKey, "aes-gcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decrypt(other, b); err == nil {
+		t.Error("Expected decryption with wrong key to fail")
+	}
+
+	if _, err := newAEAD(testKey, "rot13"); err == nil {
+		t.Error("Expected unsupported algorithm to fail")
+	}
+}
+
+func TestEncryptionBroker(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	pub := newTestBroker(t, addr, Encryption(testKey, "aes-gcm"))
+	defer pub.Disconnect()
+
+	ch := make(chan string, 1)
+	sub := newTestBroker(t, addr, Encryption(testKey, "aes-gcm"))
+	defer sub.Disconnect()
+	if _, err := sub.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	wrong := newTestBroker(t, addr, Encryption(wrongKey, "aes-gcm"), broker.ErrorHandler(func(e broker.Event) error {
+		errs <- e.Error()
+		return nil
+	}))
+	defer wrong.Disconnect()
+	if _, err := wrong.Subscribe("test", func(e broker.Event) error {
+		t.Error("Expected handler not to be called with wrong key")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pub.Publish("test", &broker.Message{Body: []byte("secret")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := receive(t, ch); body != "secret" {
+		t.Errorf("Expected %q, got %q", "secret", body)
+	}
+	if err := <-errs; err == nil {
+		t.Error("Expected decryption error in error handler")
+	}
+}
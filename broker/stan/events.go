@@ -0,0 +1,33 @@
+package stan
+
+import (
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+// subscription lifecycle events logged with LogSubscriptionEvents
+const (
+	eventSubscribe   = "subscribe"
+	eventUnsubscribe = "unsubscribe"
+	eventClose       = "close"
+	eventAck         = "ack"
+	eventNak         = "nak"
+	eventError       = "error"
+)
+
+// logEvent logs a subscription lifecycle event with structured fields, the sequence
+// is omitted for events not related to a message
+func (n *subscriber) logEvent(event string, seq uint64) {
+	if !n.events || !n.b.logEnabled(log.InfoLevel) {
+		return
+	}
+	fields := map[string]interface{}{
+		"event":   event,
+		"topic":   n.t,
+		"queue":   n.opts.Queue,
+		"durable": n.durable,
+	}
+	if seq > 0 {
+		fields["sequence"] = seq
+	}
+	n.b.logger().Fields(fields).Log(log.InfoLevel, "[stan]: subscription "+event)
+}
@@ -0,0 +1,270 @@
+package stan
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/micro/go-micro/v2/broker"
+	log "github.com/micro/go-micro/v2/logger"
+	nats "github.com/nats-io/nats.go"
+	stan "github.com/nats-io/stan.go"
+)
+
+// heartbeats missed before an instance is considered gone
+const exclusiveMissed = 3
+
+// exclusiveBeat is the heartbeat of an instance
+type exclusiveBeat struct {
+	ID     string `json:"id"`
+	Leader bool   `json:"leader"`
+}
+
+// exclusivePeer is the last heartbeat of another instance
+type exclusivePeer struct {
+	seen   time.Time
+	leader bool
+}
+
+// exclusiveSubscriber joins the durable queue group of a topic only while it leads
+// the instances exchanging heartbeats on the topic
+type exclusiveSubscriber struct {
+	b        *stanBroker
+	t        string
+	id       string
+	opts     broker.SubscribeOptions
+	handler  broker.Handler
+	member   []broker.SubscribeOption
+	interval time.Duration
+	started  time.Time
+	// heartbeat subscription and the nats connection it belongs to
+	hb *nats.Subscription
+	hc *nats.Conn
+
+	mu    sync.Mutex
+	peers map[string]exclusivePeer
+	sub   broker.Subscriber
+	quit  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// heartbeatSubject returns the core nats subject the instances of an exclusive topic
+// share, heartbeats aren't stored by the streaming server
+func heartbeatSubject(topic string) string {
+	return topic + ".exclusive"
+}
+
+// exclusiveDurable returns the durable name of the queue group of an exclusive topic
+func exclusiveDurable(topic, queue string) string {
+	return strings.Replace("exclusive."+topic+"."+queue, ":", "_", -1)
+}
+
+// ExclusiveSubscribe subscribes handler to topic on a single instance at a time.
+// Instances exchange heartbeats on the core nats subject topic.exclusive, the leader alone is a member of a
+// durable queue group on topic and a standby takes over once its heartbeats stop,
+// resuming at the group position. Messages unacked by a failed leader are
+// redelivered to its successor. While a lost leader is still connected both can
+// briefly share the queue group, every message is still handled only once.
+func (n *stanBroker) ExclusiveSubscribe(topic string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	if handler == nil {
+		return nil, ErrNilHandler
+	}
+
+	var opt broker.SubscribeOptions
+	for _, o := range opts {
+		o(&opt)
+	}
+
+	e := &exclusiveSubscriber{
+		b:        n,
+		t:        topic,
+		id:       uuid.New().String(),
+		opts:     opt,
+		handler:  handler,
+		interval: time.Second,
+		started:  time.Now(),
+		peers:    make(map[string]exclusivePeer),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	// the group is durable so a successor resumes where the leader stopped, an
+	// explicit durable name overrides the default one
+	queue := opt.Queue
+	if len(queue) == 0 {
+		queue = "exclusive"
+	}
+	var sopts []stan.SubscriptionOption
+	if opt.Context != nil {
+		sopts, _ = opt.Context.Value(subscribeOptionKey{}).([]stan.SubscriptionOption)
+		if d, ok := opt.Context.Value(exclusiveHeartbeatKey{}).(time.Duration); ok && d > 0 {
+			e.interval = d
+		}
+	}
+	sopts = append([]stan.SubscriptionOption{stan.DurableName(exclusiveDurable(topic, queue))}, sopts...)
+	e.member = append(append([]broker.SubscribeOption(nil), opts...), broker.Queue(queue), SubscribeOption(sopts...))
+
+	if err := e.listen(); err != nil {
+		return nil, err
+	}
+
+	go e.run()
+	return e, nil
+}
+
+func (e *exclusiveSubscriber) Options() broker.SubscribeOptions {
+	return e.opts
+}
+
+func (e *exclusiveSubscriber) Topic() string {
+	return e.t
+}
+
+// Unsubscribe stops the heartbeats and leaves the queue group, keeping its durable
+// for the standby instances
+func (e *exclusiveSubscriber) Unsubscribe() error {
+	e.once.Do(func() {
+		close(e.quit)
+	})
+	<-e.done
+
+	e.mu.Lock()
+	sub := e.sub
+	e.sub = nil
+	e.mu.Unlock()
+
+	var err error
+	if sub != nil {
+		err = sub.Unsubscribe()
+	}
+	if herr := e.hb.Unsubscribe(); herr != nil && herr != nats.ErrConnectionClosed && err == nil {
+		err = herr
+	}
+	return err
+}
+
+// listen subscribes to the heartbeats on the current nats connection, a reconnect
+// replaces the connection
+func (e *exclusiveSubscriber) listen() error {
+	nc := e.b.natsConn()
+	if nc == nil {
+		return errors.New("not connected")
+	}
+	if nc == e.hc {
+		return nil
+	}
+	hb, err := nc.Subscribe(heartbeatSubject(e.t), e.heartbeat)
+	if err != nil {
+		return err
+	}
+	if e.hb != nil {
+		e.hb.Unsubscribe()
+	}
+	e.hb, e.hc = hb, nc
+	return nil
+}
+
+// heartbeat records the heartbeat of another instance
+func (e *exclusiveSubscriber) heartbeat(msg *nats.Msg) {
+	var beat exclusiveBeat
+	if err := json.Unmarshal(msg.Data, &beat); err != nil || len(beat.ID) == 0 || beat.ID == e.id {
+		return
+	}
+	e.mu.Lock()
+	e.peers[beat.ID] = exclusivePeer{seen: time.Now(), leader: beat.Leader}
+	e.mu.Unlock()
+}
+
+func (e *exclusiveSubscriber) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.listen(); err != nil {
+			e.b.logf(log.WarnLevel, "[stan]: heartbeats of %s unavailable: %v", e.t, err)
+		}
+		e.elect(time.Now())
+		e.beat()
+		select {
+		case <-e.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// elect joins or leaves the queue group. A leader steps down for a live leader with
+// a smaller id, a standby takes over when no live leader is left and no live standby
+// has a smaller id. A new instance first waits to learn about the others.
+func (e *exclusiveSubscriber) elect(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	expiry := now.Add(-exclusiveMissed * e.interval)
+	leading := e.sub != nil
+	lead := leading
+	if !leading {
+		lead = now.Sub(e.started) >= exclusiveMissed*e.interval
+	}
+	for id, p := range e.peers {
+		if p.seen.Before(expiry) {
+			delete(e.peers, id)
+			continue
+		}
+		switch {
+		case p.leader && (!leading || id < e.id):
+			lead = false
+		case !p.leader && !leading && id < e.id:
+			lead = false
+		}
+	}
+
+	switch {
+	case lead && !leading:
+		sub, err := e.b.Subscribe(e.t, e.handler, e.member...)
+		if err != nil {
+			e.b.logf(log.ErrorLevel, "[stan]: exclusive subscription to %s failed: %v", e.t, err)
+			return
+		}
+		e.sub = sub
+	case !lead && leading:
+		if err := e.sub.Unsubscribe(); err != nil {
+			e.b.logf(log.ErrorLevel, "[stan]: failed to step down from %s: %v", e.t, err)
+		}
+		e.sub = nil
+	}
+}
+
+// beat publishes the heartbeat of the instance
+func (e *exclusiveSubscriber) beat() {
+	b, err := json.Marshal(exclusiveBeat{ID: e.id, Leader: e.leading()})
+	if err == nil && e.hc != nil {
+		err = e.hc.Publish(heartbeatSubject(e.t), b)
+	}
+	if err != nil {
+		e.b.logf(log.WarnLevel, "[stan]: heartbeat of %s failed: %v", e.t, err)
+	}
+}
+
+// leading reports whether the instance is a member of the queue group
+func (e *exclusiveSubscriber) leading() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.sub != nil
+}
+
+// natsConn returns the nats connection of the current streaming connection
+func (n *stanBroker) natsConn() *nats.Conn {
+	n.RLock()
+	defer n.RUnlock()
+	if n.conn == nil {
+		return nil
+	}
+	return n.conn.NatsConn()
+}
@@ -0,0 +1,127 @@
+package stan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+// waitLeader returns the first of subs to lead
+func waitLeader(t *testing.T, subs ...broker.Subscriber) int {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, sub := range subs {
+			if sub.(*exclusiveSubscriber).leading() {
+				return i
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Timeout waiting for a leader")
+	return -1
+}
+
+func TestExclusiveSubscribe(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	received := make(chan int, 20)
+	var subs []broker.Subscriber
+	for i := 0; i < 2; i++ {
+		i := i
+		b := newTestBroker(t, addr)
+		defer b.Disconnect()
+		sub, err := b.ExclusiveSubscribe("jobs", func(broker.Event) error {
+			received <- i
+			return nil
+		}, ExclusiveHeartbeat(100*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Unsubscribe()
+		subs = append(subs, sub)
+	}
+
+	// give both instances the time to settle on a single leader
+	leader := waitLeader(t, subs...)
+	time.Sleep(500 * time.Millisecond)
+	if subs[1-leader].(*exclusiveSubscriber).leading() {
+		t.Fatal("Expected a single leader")
+	}
+
+	pub := newTestBroker(t, addr)
+	defer pub.Disconnect()
+	publish := func(count int) {
+		for i := 0; i < count; i++ {
+			if err := pub.Publish("jobs", &broker.Message{Body: []byte("job")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expect := func(count, instance int) {
+		for i := 0; i < count; i++ {
+			select {
+			case got := <-received:
+				if got != instance {
+					t.Errorf("Expected instance %d to handle the message, got %d", instance, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timeout waiting for message")
+			}
+		}
+	}
+
+	publish(10)
+	expect(10, leader)
+
+	// the standby takes over once the leader stops
+	if err := subs[leader].Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if next := waitLeader(t, subs[1-leader]); next != 0 {
+		t.Fatal("Expected the standby to take over")
+	}
+	publish(5)
+	expect(5, 1-leader)
+}
+
+func TestExclusiveHeartbeatsNotStored(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	sub, err := b.ExclusiveSubscribe("jobs", func(broker.Event) error {
+		return nil
+	}, ExclusiveHeartbeat(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	waitLeader(t, sub)
+
+	// the heartbeats went over core nats, the channel has nothing to replay
+	stored := make(chan string, 1)
+	if _, err := b.Subscribe(heartbeatSubject("jobs"), func(e broker.Event) error {
+		stored <- string(e.Message().Body)
+		return nil
+	}, SubscribeOptions().DeliverAllAvailable().Build()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stored:
+		t.Error("Expected no heartbeats stored in the streaming channel")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestExclusiveDurable(t *testing.T) {
+	if exclusiveDurable("jobs", "workers") == exclusiveDurable("tasks", "workers") {
+		t.Error("Expected topics sharing a queue to use different durables")
+	}
+	if exclusiveDurable("jobs", "a") == exclusiveDurable("jobs", "b") {
+		t.Error("Expected queues of a topic to use different durables")
+	}
+}
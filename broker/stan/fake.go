@@ -0,0 +1,338 @@
+package stan
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+	"github.com/micro/go-micro/v2/codec"
+	"github.com/micro/go-micro/v2/codec/json"
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+)
+
+// FakeBroker is an in-memory broker.Broker accepting the options of the stan broker.
+// Messages are delivered synchronously on Publish, queue groups share messages round
+// robin and durable subscriptions resume after the last delivered message.
+// Options without an in-memory meaning are ignored.
+type FakeBroker struct {
+	sync.RWMutex
+	opts      broker.Options
+	connected bool
+	// published messages per topic, the index is the sequence minus one
+	log      map[string][]fakeEntry
+	subs     map[string][]*fakeSubscriber
+	durables map[string]int
+	next     map[string]int
+}
+
+type fakeEntry struct {
+	seq       uint64
+	data      []byte
+	timestamp time.Time
+}
+
+type fakeSubscriber struct {
+	b       *FakeBroker
+	t       string
+	opts    broker.SubscribeOptions
+	durable string
+	match   map[string]string
+	handler broker.Handler
+	raw     func(*stan.Msg) error
+}
+
+type fakeEvent struct {
+	t   string
+	m   *broker.Message
+	err error
+}
+
+func (e *fakeEvent) Topic() string {
+	return e.t
+}
+
+func (e *fakeEvent) Message() *broker.Message {
+	return e.m
+}
+
+func (e *fakeEvent) Ack() error {
+	return nil
+}
+
+func (e *fakeEvent) Error() error {
+	return e.err
+}
+
+func (s *fakeSubscriber) Options() broker.SubscribeOptions {
+	return s.opts
+}
+
+func (s *fakeSubscriber) Topic() string {
+	return s.t
+}
+
+// Unsubscribe removes the subscription, a durable keeps its position
+func (s *fakeSubscriber) Unsubscribe() error {
+	s.b.Lock()
+	defer s.b.Unlock()
+	subs := s.b.subs[s.t]
+	for i, sub := range subs {
+		if sub == s {
+			s.b.subs[s.t] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// key identifies the durable state of the subscription
+func (s *fakeSubscriber) key() string {
+	return s.t + "/" + s.opts.Queue + "/" + s.durable
+}
+
+func (s *fakeSubscriber) deliver(e fakeEntry) {
+	if s.raw != nil {
+		s.raw(&stan.Msg{MsgProto: pb.MsgProto{
+			Sequence:  e.seq,
+			Subject:   s.t,
+			Data:      e.data,
+			Timestamp: e.timestamp.UnixNano(),
+		}})
+		return
+	}
+	s.b.RLock()
+	c := s.b.codec()
+	s.b.RUnlock()
+	p := &fakeEvent{t: s.t, m: &broker.Message{}}
+	if err := c.Unmarshal(e.data, p.m); err != nil {
+		p.err = err
+		p.m.Body = e.data
+	}
+	if !matchHeaders(p.m.Header, s.match) {
+		return
+	}
+	s.handler(p)
+}
+
+// NewFakeBroker returns an in-memory broker for tests
+func NewFakeBroker(opts ...broker.Option) *FakeBroker {
+	options := broker.Options{
+		// Default codec
+		Codec:   json.Marshaler{},
+		Context: context.Background(),
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	return &FakeBroker{
+		opts:     options,
+		log:      make(map[string][]fakeEntry),
+		subs:     make(map[string][]*fakeSubscriber),
+		durables: make(map[string]int),
+		next:     make(map[string]int),
+	}
+}
+
+func (f *FakeBroker) Init(opts ...broker.Option) error {
+	f.Lock()
+	defer f.Unlock()
+	for _, o := range opts {
+		o(&f.opts)
+	}
+	return nil
+}
+
+func (f *FakeBroker) Options() broker.Options {
+	f.RLock()
+	defer f.RUnlock()
+	return f.opts
+}
+
+func (f *FakeBroker) Address() string {
+	f.RLock()
+	defer f.RUnlock()
+	if len(f.opts.Addrs) > 0 {
+		return f.opts.Addrs[0]
+	}
+	return "memory"
+}
+
+func (f *FakeBroker) Connect() error {
+	f.Lock()
+	f.connected = true
+	f.Unlock()
+	return nil
+}
+
+func (f *FakeBroker) Disconnect() error {
+	f.Lock()
+	f.connected = false
+	f.subs = make(map[string][]*fakeSubscriber)
+	f.Unlock()
+	return nil
+}
+
+func (f *FakeBroker) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	f.Lock()
+	topic = subjectName(f.opts.Context, topic)
+	if !f.connected {
+		f.Unlock()
+		return errors.New("not connected")
+	}
+	b, err := f.codec().Marshal(msg)
+	if err != nil {
+		f.Unlock()
+		return err
+	}
+
+	seq := len(f.log[topic]) + 1
+	e := fakeEntry{seq: uint64(seq), data: b, timestamp: time.Now()}
+	f.log[topic] = append(f.log[topic], e)
+
+	// every plain subscription gets the message, a queue group only one member
+	var targets []*fakeSubscriber
+	groups := make(map[string][]*fakeSubscriber)
+	for _, s := range f.subs[topic] {
+		if len(s.opts.Queue) == 0 {
+			targets = append(targets, s)
+			continue
+		}
+		groups[s.opts.Queue] = append(groups[s.opts.Queue], s)
+	}
+	for queue, members := range groups {
+		k := topic + "/" + queue
+		targets = append(targets, members[f.next[k]%len(members)])
+		f.next[k]++
+	}
+	for _, s := range targets {
+		if len(s.durable) > 0 {
+			f.durables[s.key()] = seq
+		}
+	}
+	f.Unlock()
+
+	for _, s := range targets {
+		s.deliver(e)
+	}
+	return nil
+}
+
+func (f *FakeBroker) Subscribe(topic string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	// a snapshot, Init may replace the options concurrently
+	fopts := f.Options()
+	topic = subjectName(fopts.Context, topic)
+	opt := broker.SubscribeOptions{
+		AutoAck: true,
+	}
+
+	// broker level defaults are applied first so per call options override them
+	if defaults, ok := fopts.Context.Value(defaultSubscribeOptionsKey{}).([]broker.SubscribeOption); ok {
+		opts = append(append([]broker.SubscribeOption(nil), defaults...), opts...)
+	}
+
+	for _, o := range opts {
+		o(&opt)
+	}
+
+	// Make sure context is setup
+	if opt.Context == nil {
+		opt.Context = context.Background()
+	}
+
+	ctx := opt.Context
+	if subscribeContext, ok := ctx.Value(subscribeContextKey{}).(context.Context); ok && subscribeContext != nil {
+		ctx = subscribeContext
+	}
+
+	bopts := stan.DefaultSubscriptionOptions
+	if subOpts, ok := ctx.Value(subscribeOptionKey{}).([]stan.SubscriptionOption); ok {
+		for _, bopt := range subOpts {
+			if err := bopt(&bopts); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if dn, ok := fopts.Context.Value(durableKey{}).(string); ok && len(dn) > 0 {
+		bopts.DurableName = dn
+	}
+
+	s := &fakeSubscriber{
+		b:       f,
+		t:       topic,
+		opts:    opt,
+		durable: bopts.DurableName,
+		handler: handler,
+	}
+	s.match, _ = ctx.Value(matchHeadersKey{}).(map[string]string)
+	s.raw, _ = ctx.Value(rawHandlerKey{}).(func(*stan.Msg) error)
+	if handler == nil && s.raw == nil {
+		return nil, ErrNilHandler
+	}
+
+	f.Lock()
+	if !f.connected {
+		f.Unlock()
+		return nil, errors.New("not connected")
+	}
+
+	log := f.log[topic]
+	start := len(log)
+	if off, ok := f.durables[s.key()]; ok && len(s.durable) > 0 {
+		// a durable resumes after the last delivered message
+		start = off
+	} else {
+		start = fakeStart(log, bopts)
+	}
+	replay := append([]fakeEntry(nil), log[start:]...)
+	if len(s.durable) > 0 {
+		f.durables[s.key()] = len(log)
+	}
+	f.subs[topic] = append(f.subs[topic], s)
+	f.Unlock()
+
+	for _, e := range replay {
+		s.deliver(e)
+	}
+	return s, nil
+}
+
+// codec returns the configured codec, falling back to json if an option cleared it,
+// it must be called with the lock held
+func (f *FakeBroker) codec() codec.Marshaler {
+	if f.opts.Codec == nil {
+		return json.Marshaler{}
+	}
+	return f.opts.Codec
+}
+
+func (f *FakeBroker) String() string {
+	return "stan"
+}
+
+// fakeStart returns the log offset a new subscription starts at
+func fakeStart(log []fakeEntry, opts stan.SubscriptionOptions) int {
+	switch opts.StartAt {
+	case pb.StartPosition_First:
+		return 0
+	case pb.StartPosition_LastReceived:
+		if len(log) > 0 {
+			return len(log) - 1
+		}
+	case pb.StartPosition_SequenceStart:
+		if opts.StartSequence > 0 && int(opts.StartSequence) <= len(log) {
+			return int(opts.StartSequence) - 1
+		}
+	case pb.StartPosition_TimeDeltaStart:
+		for i, e := range log {
+			if !e.timestamp.Before(opts.StartTime) {
+				return i
+			}
+		}
+	}
+	return len(log)
+}
@@ -0,0 +1,175 @@
+package stan
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/micro/go-micro/v2/broker"
+	"github.com/micro/go-micro/v2/codec/json"
+	stan "github.com/nats-io/stan.go"
+)
+
+func TestFakeBroker(t *testing.T) {
+	b := NewFakeBroker(ClusterID("test-cluster"))
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect()
+
+	var got []string
+	sub, err := b.Subscribe("test", func(e broker.Event) error {
+		got = append(got, e.Topic()+":"+e.Message().Header["Id"]+":"+string(e.Message().Body))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("test", &broker.Message{Header: map[string]string{"Id": "1"}, Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("dropped")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 || got[0] != "test:1:hello" {
+		t.Errorf("Expected one round-trip message, got %v", got)
+	}
+}
+
+func TestFakeBrokerQueue(t *testing.T) {
+	b := NewFakeBroker()
+	b.Connect()
+	defer b.Disconnect()
+
+	counts := make([]int, 2)
+	for i := range counts {
+		i := i
+		if _, err := b.Subscribe("test", func(e broker.Event) error {
+			counts[i]++
+			return nil
+		}, broker.Queue("workers")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		b.Publish("test", &broker.Message{Body: []byte("msg")})
+	}
+	if counts[0] != 2 || counts[1] != 2 {
+		t.Errorf("Expected messages shared by the queue group, got %v", counts)
+	}
+}
+
+func TestFakeBrokerDurable(t *testing.T) {
+	b := NewFakeBroker(DurableName("durable"))
+	b.Connect()
+	defer b.Disconnect()
+
+	var got []string
+	handler := func(e broker.Event) error {
+		got = append(got, string(e.Message().Body))
+		return nil
+	}
+
+	sub, err := b.Subscribe("test", handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish("test", &broker.Message{Body: []byte("1")})
+	sub.Unsubscribe()
+
+	b.Publish("test", &broker.Message{Body: []byte("2")})
+	b.Publish("test", &broker.Message{Body: []byte("3")})
+
+	// resuming ignores the start position
+	if _, err := b.Subscribe("test", handler, SubscribeOption(stan.DeliverAllAvailable())); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[1] != "2" || got[2] != "3" {
+		t.Errorf("Expected the durable to resume after the last delivered message, got %v", got)
+	}
+}
+
+func TestFakeBrokerNotConnected(t *testing.T) {
+	b := NewFakeBroker()
+	if err := b.Publish("test", &broker.Message{}); err == nil {
+		t.Error("Expected publish to fail before Connect")
+	}
+	if _, err := b.Subscribe("test", func(broker.Event) error { return nil }); err == nil {
+		t.Error("Expected subscribe to fail before Connect")
+	}
+}
+
+var _ broker.Broker = (*FakeBroker)(nil)
+
+func TestFakeBrokerNilCodec(t *testing.T) {
+	b := NewFakeBroker(broker.Codec(nil))
+	b.Connect()
+	defer b.Disconnect()
+
+	var got string
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		got = string(e.Message().Body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", got)
+	}
+}
+
+func TestFakeBrokerConcurrentInit(t *testing.T) {
+	b := NewFakeBroker()
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect()
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := 0; i < 200; i++ {
+			runtime.Gosched()
+			if err := b.Init(DefaultTopic("test"), broker.Codec(json.Marshaler{})); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := 0; i < 200; i++ {
+			runtime.Gosched()
+			if _, err := b.Subscribe("test", func(broker.Event) error { return nil }); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := 0; i < 200; i++ {
+			runtime.Gosched()
+			if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	close(start)
+	wg.Wait()
+}
@@ -0,0 +1,32 @@
+package stan
+
+import (
+	"sync"
+
+	stan "github.com/nats-io/stan.go"
+)
+
+// gapDetector reports received sequences that don't follow the previous one.
+// Redeliveries and older sequences don't move the last sequence back.
+type gapDetector struct {
+	sync.Mutex
+	last uint64
+	fn   func(expected, got uint64)
+}
+
+func newGapDetector(fn func(expected, got uint64)) *gapDetector {
+	return &gapDetector{fn: fn}
+}
+
+func (g *gapDetector) observe(msg *stan.Msg) {
+	g.Lock()
+	last := g.last
+	if msg.Sequence > last {
+		g.last = msg.Sequence
+	}
+	g.Unlock()
+
+	if last > 0 && msg.Sequence > last+1 {
+		g.fn(last+1, msg.Sequence)
+	}
+}
@@ -0,0 +1,61 @@
+package stan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+	natsd "github.com/nats-io/nats-server/v2/server"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	stan "github.com/nats-io/stan.go"
+)
+
+func TestDetectGaps(t *testing.T) {
+	// the channel keeps the last two messages only
+	addr, shutdown := runServerWith(t, func(sopts *stand.Options, nopts *natsd.Options) {
+		sopts.MaxMsgs = 2
+	})
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	type gap struct{ expected, got uint64 }
+	gaps := make(chan gap, 1)
+	release := make(chan struct{})
+	received := make(chan string, 5)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		body := string(e.Message().Body)
+		if body == "1" {
+			<-release
+		}
+		received <- body
+		return nil
+	}, SubscribeOption(stan.MaxInflight(1)), DetectGaps(func(expected, got uint64) {
+		gaps <- gap{expected, got}
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"1", "2", "3", "4", "5"} {
+		if err := b.Publish("test", &broker.Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 2 and 3 are discarded while the handler holds 1
+	close(release)
+
+	for _, want := range []string{"1", "4", "5"} {
+		if got := receive(t, received); got != want {
+			t.Fatalf("Expected message %s, got %s", want, got)
+		}
+	}
+	select {
+	case g := <-gaps:
+		if g.expected != 2 || g.got != 4 {
+			t.Errorf("Expected a gap from 2 to 4, got %d to %d", g.expected, g.got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the gap to be detected")
+	}
+}
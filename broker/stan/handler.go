@@ -0,0 +1,94 @@
+package stan
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+// ErrHandlerTimeout is reported to the error handler when a handler exceeds its HandlerTimeout
+var ErrHandlerTimeout = errors.New("[stan]: handler timeout")
+
+// ErrNilHandler is returned by Subscribe when neither a handler nor a RawHandler is given
+var ErrNilHandler = errors.New("[stan]: nil handler")
+
+// PermanentError marks a handler error that redelivery won't fix. The message is acked
+// instead of redelivered and published to the DeadLetter topic if one is set.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err in a PermanentError
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// isPermanent reports whether err unwraps to a PermanentError
+func isPermanent(err error) bool {
+	var pe *PermanentError
+	return errors.As(err, &pe)
+}
+
+// timeoutHandler runs the handler with a deadline, the deadline is available to the
+// handler through EventContext. A handler that ignores it keeps running in the background.
+// Each call gets a copy of the publication so a retry starts from the parent context.
+func timeoutHandler(td time.Duration, h broker.Handler) broker.Handler {
+	return func(e broker.Event) error {
+		ctx, cancel := context.WithTimeout(EventContext(e), td)
+		defer cancel()
+		if p, ok := e.(*publication); ok {
+			cp := *p
+			cp.ctx = ctx
+			e = &cp
+		}
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- h(e)
+		}()
+
+		select {
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+			return ErrHandlerTimeout
+		}
+	}
+}
+
+// retryHandler invokes the handler up to attempts times, doubling the backoff between
+// attempts, and returns the last error so redelivery can take over. Permanent errors
+// are not retried.
+func retryHandler(attempts int, backoff time.Duration, h broker.Handler) broker.Handler {
+	return func(e broker.Event) error {
+		var err error
+		wait := backoff
+		for i := 0; i < attempts; i++ {
+			if i > 0 {
+				select {
+				case <-time.After(wait):
+				case <-EventContext(e).Done():
+					return err
+				}
+				wait *= 2
+			}
+			if err = h(e); err == nil || isPermanent(err) {
+				return err
+			}
+		}
+		return err
+	}
+}
@@ -0,0 +1,169 @@
+package stan
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestHandlerTimeout(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	errs := make(chan error, 1)
+	b := newTestBroker(t, addr, broker.ErrorHandler(func(e broker.Event) error {
+		errs <- e.Error()
+		return nil
+	}))
+	defer b.Disconnect()
+
+	var calls int32
+	done := make(chan bool, 1)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// first delivery hangs until the deadline passes
+			<-EventContext(e).Done()
+			return nil
+		}
+		done <- e.(*publication).msg.Redelivered
+		return nil
+	}, HandlerTimeout(100*time.Millisecond), SubscribeOptions().AckWait(time.Second).Build()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("test", &broker.Message{Body: []byte("slow")}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != ErrHandlerTimeout {
+			t.Errorf("Expected %v, got %v", ErrHandlerTimeout, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for error handler")
+	}
+
+	select {
+	case redelivered := <-done:
+		if !redelivered {
+			t.Error("Expected timed out message to be redelivered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for redelivery")
+	}
+}
+
+func TestRetryHandler(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	var calls int32
+	done := make(chan struct{}, 1)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return errors.New("transient failure")
+		}
+		done <- struct{}{}
+		return nil
+	}, AckOnSuccess(), RetryHandler(3, 10*time.Millisecond), SubscribeOptions().AckWait(time.Second).Build()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("test", &broker.Message{Body: []byte("flaky")}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for handler to succeed")
+	}
+
+	// acked after the in process retries, so it isn't redelivered after AckWait
+	time.Sleep(1500 * time.Millisecond)
+	if c := atomic.LoadInt32(&calls); c != 3 {
+		t.Errorf("Expected 3 handler calls, got %d", c)
+	}
+}
+
+func TestRetryHandlerTimeout(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	errs := make(chan error, 1)
+	b := newTestBroker(t, addr, broker.ErrorHandler(func(e broker.Event) error {
+		errs <- e.Error()
+		return nil
+	}))
+	defer b.Disconnect()
+
+	var calls int32
+	done := make(chan error, 1)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// the first attempt hangs until its deadline passes
+			<-EventContext(e).Done()
+			return nil
+		}
+		// later attempts start with a fresh deadline
+		done <- EventContext(e).Err()
+		return nil
+	}, AckOnSuccess(), HandlerTimeout(100*time.Millisecond), RetryHandler(3, 10*time.Millisecond), SubscribeOptions().AckWait(time.Second).Build()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("test", &broker.Message{Body: []byte("slow")}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the retry to start with a live context, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the retry to succeed")
+	}
+
+	select {
+	case err := <-errs:
+		t.Errorf("Expected the retry to succeed, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if c := atomic.LoadInt32(&calls); c != 2 {
+		t.Errorf("Expected 2 handler calls, got %d", c)
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	base := errors.New("invalid payload")
+	if !isPermanent(fmt.Errorf("decode: %w", Permanent(base))) {
+		t.Error("Expected a wrapped PermanentError to be permanent")
+	}
+	if isPermanent(base) {
+		t.Error("Expected a plain error not to be permanent")
+	}
+	if Permanent(nil) != nil {
+		t.Error("Expected Permanent(nil) to be nil")
+	}
+
+	var calls int32
+	h := retryHandler(3, time.Millisecond, func(broker.Event) error {
+		atomic.AddInt32(&calls, 1)
+		return Permanent(base)
+	})
+	if err := h(&publication{}); !errors.Is(err, base) {
+		t.Errorf("Expected the permanent error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected permanent errors not to be retried, got %d calls", calls)
+	}
+}
@@ -0,0 +1,82 @@
+package stan
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+// flag byte prefixing payloads with compact headers, it can't start a json envelope
+const payloadCompactHeaders byte = 0xc1
+
+var errCompactHeaders = errors.New("[stan]: malformed compact headers")
+
+// marshalCompact encodes the headers of msg as a count followed by length prefixed
+// keys and values, the body follows as is
+func marshalCompact(msg *broker.Message) []byte {
+	keys := make([]string, 0, len(msg.Header))
+	size := 1 + binary.MaxVarintLen64
+	for k, v := range msg.Header {
+		keys = append(keys, k)
+		size += 2*binary.MaxVarintLen64 + len(k) + len(v)
+	}
+	sort.Strings(keys)
+
+	b := make([]byte, 0, size+len(msg.Body))
+	b = append(b, payloadCompactHeaders)
+	b = appendUvarint(b, uint64(len(keys)))
+	for _, k := range keys {
+		b = appendString(b, k)
+		b = appendString(b, msg.Header[k])
+	}
+	return append(b, msg.Body...)
+}
+
+// unmarshalCompact reverses marshalCompact
+func unmarshalCompact(data []byte) (*broker.Message, error) {
+	if len(data) == 0 || data[0] != payloadCompactHeaders {
+		return nil, errCompactHeaders
+	}
+	data = data[1:]
+
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)) {
+		return nil, errCompactHeaders
+	}
+	data = data[n:]
+
+	m := &broker.Message{Header: make(map[string]string, count)}
+	for i := uint64(0); i < count; i++ {
+		var k, v string
+		var ok bool
+		if k, data, ok = readString(data); !ok {
+			return nil, errCompactHeaders
+		}
+		if v, data, ok = readString(data); !ok {
+			return nil, errCompactHeaders
+		}
+		m.Header[k] = v
+	}
+	m.Body = append([]byte(nil), data...)
+	return m, nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+func readString(data []byte) (string, []byte, bool) {
+	l, n := binary.Uvarint(data)
+	if n <= 0 || l > uint64(len(data)-n) {
+		return "", nil, false
+	}
+	data = data[n:]
+	return string(data[:l]), data[l:], true
+}
@@ -0,0 +1,88 @@
+package stan
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/micro/go-micro/v2/broker"
+	"github.com/micro/go-micro/v2/codec/json"
+	stan "github.com/nats-io/stan.go"
+)
+
+func TestCompactHeadersRoundTrip(t *testing.T) {
+	msg := &broker.Message{Header: make(map[string]string), Body: []byte("ok")}
+	for i := 0; i < 20; i++ {
+		msg.Header[fmt.Sprintf("Header-%d", i)] = fmt.Sprintf("value-%d", i)
+	}
+
+	compact := marshalCompact(msg)
+	envelope, err := json.Marshaler{}.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compact) >= len(envelope) {
+		t.Errorf("Expected compact headers to be smaller than the envelope, got %d and %d bytes", len(compact), len(envelope))
+	}
+
+	out, err := unmarshalCompact(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Body, msg.Body) || len(out.Header) != len(msg.Header) {
+		t.Fatalf("Expected %v, got %v", msg, out)
+	}
+	for k, v := range msg.Header {
+		if out.Header[k] != v {
+			t.Errorf("Expected header %s to be %q, got %q", k, v, out.Header[k])
+		}
+	}
+
+	if _, err := unmarshalCompact(compact[:len(compact)/2]); err == nil {
+		t.Error("Expected truncated headers to fail")
+	}
+}
+
+func TestCompactHeaders(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, CompactHeaders(true))
+	defer b.Disconnect()
+
+	flags := make(chan byte, 2)
+	if _, err := b.conn.Subscribe("test", func(msg *stan.Msg) {
+		flags <- msg.Data[0]
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := make(chan string, 2)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		headers <- e.Message().Header["Foo"] + " " + string(e.Message().Body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// envelopes of publishers without the option are still decoded
+	plain := newTestBroker(t, addr)
+	defer plain.Disconnect()
+
+	msg := &broker.Message{Header: map[string]string{"Foo": "bar"}, Body: []byte("hello")}
+	if err := b.Publish("test", msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Publish("test", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, flag := range []byte{payloadCompactHeaders, '{'} {
+		if got := <-flags; got != flag {
+			t.Errorf("Expected payload flag %x, got %x", flag, got)
+		}
+		if got := receive(t, headers); got != "bar hello" {
+			t.Errorf("Expected %q, got %q", "bar hello", got)
+		}
+	}
+}
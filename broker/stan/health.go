@@ -0,0 +1,50 @@
+package stan
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+type healthStatus struct {
+	Ready        bool   `json:"ready"`
+	URL          string `json:"url,omitempty"`
+	Reconnecting bool   `json:"reconnecting"`
+}
+
+// HealthHandler returns a handler responding 200 while the broker is ready and 503
+// otherwise, the JSON body carries the connected url and reconnect state. Brokers
+// without a Ready method are reported as not ready.
+func HealthHandler(b broker.Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var status healthStatus
+		if rb, ok := b.(interface{ Ready() bool }); ok {
+			status.Ready = rb.Ready()
+		}
+		if n, ok := b.(*stanBroker); ok {
+			status.URL = n.connectedURL()
+			status.Reconnecting = atomic.LoadInt32(&n.reconnecting) == 1
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// connectedURL returns the url of the nats server the broker is connected to
+func (n *stanBroker) connectedURL() string {
+	n.RLock()
+	defer n.RUnlock()
+	if n.conn == nil {
+		return ""
+	}
+	if nc := n.conn.NatsConn(); nc != nil {
+		return nc.ConnectedUrl()
+	}
+	return ""
+}
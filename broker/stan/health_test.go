@@ -0,0 +1,43 @@
+package stan
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+	h := HealthHandler(b)
+
+	check := func(code int) healthStatus {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/health", nil))
+		if w.Code != code {
+			t.Errorf("Expected status %d, got %d", code, w.Code)
+		}
+		var status healthStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	status := check(http.StatusOK)
+	if !status.Ready || !strings.HasSuffix(status.URL, addr) {
+		t.Errorf("Expected a ready broker connected to %s, got %+v", addr, status)
+	}
+
+	if err := b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if status := check(http.StatusServiceUnavailable); status.Ready || len(status.URL) > 0 {
+		t.Errorf("Expected a disconnected broker, got %+v", status)
+	}
+}
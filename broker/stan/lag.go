@@ -0,0 +1,38 @@
+package stan
+
+import "time"
+
+// lagInterval is how often LagAlert samples the pending messages
+const lagInterval = 250 * time.Millisecond
+
+type lagAlert struct {
+	threshold int
+	cb        func(pending int)
+}
+
+// watchLag calls the alert callback when the pending messages rise above the
+// threshold, it fires again once they fell back to the threshold and rise again
+func (n *subscriber) watchLag(alert lagAlert) {
+	ticker := time.NewTicker(lagInterval)
+	defer ticker.Stop()
+
+	above := false
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-ticker.C:
+		}
+		pending, err := n.Pending()
+		if err != nil {
+			continue
+		}
+		switch {
+		case pending > alert.threshold && !above:
+			above = true
+			alert.cb(pending)
+		case pending <= alert.threshold:
+			above = false
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package stan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestLagAlert(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	release := make(chan struct{})
+	alerts := make(chan int, 10)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		<-release
+		return nil
+	}, LagAlert(5, func(pending int) {
+		alerts <- pending
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := b.Publish("test", &broker.Message{Body: []byte("slow")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case pending := <-alerts:
+		if pending <= 5 {
+			t.Errorf("Expected the alert above the threshold, got %d pending", pending)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a lag alert")
+	}
+
+	// staying above the threshold doesn't fire again
+	select {
+	case pending := <-alerts:
+		t.Errorf("Expected a single alert, got another at %d pending", pending)
+	case <-time.After(3 * lagInterval):
+	}
+	close(release)
+}
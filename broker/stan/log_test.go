@@ -0,0 +1,122 @@
+package stan
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+	"github.com/micro/go-micro/v2/logger"
+)
+
+// captureLogger records the level and fields of every entry
+type captureLogger struct {
+	*captured
+	fields map[string]interface{}
+}
+
+type captured struct {
+	sync.Mutex
+	levels []logger.Level
+	fields []map[string]interface{}
+}
+
+func newCaptureLogger() *captureLogger {
+	return &captureLogger{captured: &captured{}}
+}
+
+func (c *captureLogger) Init(...logger.Option) error              { return nil }
+func (c *captureLogger) Options() logger.Options                  { return logger.Options{} }
+func (c *captureLogger) Log(level logger.Level, v ...interface{}) { c.Logf(level, "") }
+func (c *captureLogger) String() string                           { return "capture" }
+
+func (c *captureLogger) Fields(fields map[string]interface{}) logger.Logger {
+	return &captureLogger{captured: c.captured, fields: fields}
+}
+
+func (c *captureLogger) Logf(level logger.Level, _ string, _ ...interface{}) {
+	c.Lock()
+	c.levels = append(c.levels, level)
+	c.captured.fields = append(c.captured.fields, c.fields)
+	c.Unlock()
+}
+
+func TestLogLevel(t *testing.T) {
+	testCases := []struct {
+		level  logger.Level
+		levels string
+	}{
+		{logger.ErrorLevel, "[error]"},
+		{logger.DebugLevel, "[debug error]"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.level.String(), func(t *testing.T) {
+			l := newCaptureLogger()
+			b := NewBroker(ClusterID(testClusterID), broker.Addrs(fmt.Sprintf("127.0.0.1:%d", freePort(t))),
+				ConnectTimeout(1500*time.Millisecond), Logger(l), LogLevel(tc.level))
+			if err := b.Connect(); err == nil {
+				t.Fatal("Expected connect to time out")
+			}
+			l.Lock()
+			defer l.Unlock()
+			if fmt.Sprint(l.levels) != tc.levels {
+				t.Errorf("Expected entries %s, got %v", tc.levels, l.levels)
+			}
+		})
+	}
+}
+
+func TestLogSubscriptionEvents(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	l := newCaptureLogger()
+	b := newTestBroker(t, addr, Logger(l), LogSubscriptionEvents(true), DurableName("audit"))
+	defer b.Disconnect()
+
+	done := make(chan struct{}, 2)
+	sub, err := b.Subscribe("test", func(e broker.Event) error {
+		defer func() { done <- struct{}{} }()
+		if string(e.Message().Body) == "fail" {
+			return errors.New("failed")
+		}
+		return nil
+	}, broker.Queue("workers"), AckOnSuccess())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"ok", "fail"} {
+		if err := b.Publish("test", &broker.Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for message")
+		}
+	}
+	// the outcome is logged once the handler returned
+	time.Sleep(100 * time.Millisecond)
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	var events []string
+	for _, f := range l.captured.fields {
+		if f == nil {
+			continue
+		}
+		events = append(events, fmt.Sprintf("%v:%v", f["event"], f["sequence"]))
+		if f["topic"] != "test" || f["queue"] != "workers" || f["durable"] != "audit" {
+			t.Errorf("Unexpected event fields %v", f)
+		}
+	}
+	if got := strings.Join(events, " "); got != "subscribe:<nil> ack:1 nak:2 close:<nil>" {
+		t.Errorf("Unexpected events %s", got)
+	}
+}
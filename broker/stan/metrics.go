@@ -0,0 +1,43 @@
+package stan
+
+// Counters reported to the MetricsCollector
+const (
+	// MetricReceived counts the messages received by a subscription
+	MetricReceived = "stan_messages_received"
+	// MetricHandled counts the messages the handler succeeded on
+	MetricHandled = "stan_messages_handled"
+	// MetricFailed counts the messages the handler failed on
+	MetricFailed = "stan_messages_failed"
+)
+
+// MetricsCollector receives the counters of the subscriptions, e.g. backed by
+// prometheus counter vectors. The labels hold the topic and the MetricLabels of
+// the subscription, they are shared between calls and must not be modified.
+type MetricsCollector interface {
+	Inc(name string, labels map[string]string)
+}
+
+// subMetrics reports the counters of a subscription, a nil one reports nothing
+type subMetrics struct {
+	c      MetricsCollector
+	labels map[string]string
+}
+
+// newSubMetrics returns the metrics of a subscription to topic, a label named
+// topic overrides the topic
+func newSubMetrics(c MetricsCollector, topic string, labels map[string]string) *subMetrics {
+	if c == nil {
+		return nil
+	}
+	m := &subMetrics{c: c, labels: map[string]string{"topic": topic}}
+	for k, v := range labels {
+		m.labels[k] = v
+	}
+	return m
+}
+
+func (m *subMetrics) inc(name string) {
+	if m != nil {
+		m.c.Inc(name, m.labels)
+	}
+}
@@ -0,0 +1,82 @@
+package stan
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+// fakeCollector counts by name and sorted labels
+type fakeCollector struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+func (f *fakeCollector) Inc(name string, labels map[string]string) {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	f.Lock()
+	f.counts[name+"{"+strings.Join(pairs, ",")+"}"]++
+	f.Unlock()
+}
+
+func (f *fakeCollector) count(key string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.counts[key]
+}
+
+func TestMetricLabels(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	c := &fakeCollector{counts: make(map[string]int)}
+	b := newTestBroker(t, addr, Metrics(c))
+	defer b.Disconnect()
+
+	done := make(chan string, 10)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		done <- "billing"
+		return nil
+	}, MetricLabels(map[string]string{"consumer": "billing", "team": "payments"})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		done <- "audit"
+		return errors.New("failed")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, done)
+	receive(t, done)
+
+	// the counters follow once the handlers returned
+	deadline := time.Now().Add(5 * time.Second)
+	for (c.count(MetricFailed+"{topic=test}") == 0 || c.count(MetricHandled+"{consumer=billing,team=payments,topic=test}") == 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for key, want := range map[string]int{
+		MetricReceived + "{consumer=billing,team=payments,topic=test}": 1,
+		MetricHandled + "{consumer=billing,team=payments,topic=test}":  1,
+		MetricReceived + "{topic=test}":                                1,
+		MetricFailed + "{topic=test}":                                  1,
+		MetricHandled + "{topic=test}":                                 0,
+	} {
+		if got := c.count(key); got != want {
+			t.Errorf("Expected %s to be %d, got %d", key, want, got)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package stan
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+// MirroringBroker publishes to the primary broker and copies every successful
+// publish to the secondary one in the background, e.g. while migrating to another
+// cluster. Mirroring is best effort: copies that don't fit in the buffer or fail on
+// the secondary are dropped and counted, they never block or fail the primary.
+// Everything but Publish, Connect and Disconnect is served by the primary.
+type MirroringBroker struct {
+	// first for the alignment of atomic access
+	dropped uint64
+
+	broker.Broker
+	secondary broker.Broker
+	size      int
+
+	mu    sync.Mutex
+	queue chan mirrored
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+type mirrored struct {
+	topic string
+	msg   *broker.Message
+	opts  []broker.PublishOption
+}
+
+// NewMirroringBroker returns a broker mirroring the publishes of primary to
+// secondary, buffering up to buffer copies
+func NewMirroringBroker(primary, secondary broker.Broker, buffer int) *MirroringBroker {
+	if buffer < 1 {
+		buffer = 1
+	}
+	return &MirroringBroker{
+		Broker:    primary,
+		secondary: secondary,
+		size:      buffer,
+	}
+}
+
+// Connect connects both brokers and starts mirroring
+func (m *MirroringBroker) Connect() error {
+	if err := m.Broker.Connect(); err != nil {
+		return err
+	}
+	if err := m.secondary.Connect(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.queue == nil {
+		m.queue = make(chan mirrored, m.size)
+		m.quit = make(chan struct{})
+		m.wg.Add(1)
+		go m.run(m.queue, m.quit)
+	}
+	return nil
+}
+
+// Disconnect stops mirroring, buffered copies are sent first, and disconnects both
+// brokers
+func (m *MirroringBroker) Disconnect() error {
+	m.mu.Lock()
+	if m.queue != nil {
+		close(m.quit)
+		m.queue = nil
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+
+	err := m.Broker.Disconnect()
+	if serr := m.secondary.Disconnect(); serr != nil && err == nil {
+		err = serr
+	}
+	return err
+}
+
+// Publish publishes to the primary and queues a copy for the secondary on success
+func (m *MirroringBroker) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	if err := m.Broker.Publish(topic, msg, opts...); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.queue == nil {
+		atomic.AddUint64(&m.dropped, 1)
+		return nil
+	}
+	select {
+	case m.queue <- mirrored{topic: topic, msg: copyMessage(msg), opts: opts}:
+	default:
+		atomic.AddUint64(&m.dropped, 1)
+	}
+	return nil
+}
+
+// copyMessage copies msg for the mirror queue, the caller may reuse it once Publish
+// returned
+func copyMessage(msg *broker.Message) *broker.Message {
+	c := &broker.Message{Body: append([]byte(nil), msg.Body...)}
+	if msg.Header != nil {
+		c.Header = make(map[string]string, len(msg.Header))
+		for k, v := range msg.Header {
+			c.Header[k] = v
+		}
+	}
+	return c
+}
+
+// Dropped returns the number of publishes that weren't mirrored
+func (m *MirroringBroker) Dropped() uint64 {
+	return atomic.LoadUint64(&m.dropped)
+}
+
+func (m *MirroringBroker) String() string {
+	return m.Broker.String()
+}
+
+func (m *MirroringBroker) run(queue chan mirrored, quit chan struct{}) {
+	defer m.wg.Done()
+	for {
+		select {
+		case c := <-queue:
+			m.mirror(c)
+		case <-quit:
+			// send what is buffered already
+			for {
+				select {
+				case c := <-queue:
+					m.mirror(c)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (m *MirroringBroker) mirror(c mirrored) {
+	if err := m.secondary.Publish(c.topic, c.msg, c.opts...); err != nil {
+		atomic.AddUint64(&m.dropped, 1)
+	}
+}
@@ -0,0 +1,97 @@
+package stan
+
+import (
+	"testing"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestMirroringBroker(t *testing.T) {
+	primaryAddr, shutdownPrimary := runServer(t)
+	defer shutdownPrimary()
+	secondaryAddr, shutdownSecondary := runServer(t)
+	defer shutdownSecondary()
+
+	primary := NewBroker(ClusterID(testClusterID), broker.Addrs(primaryAddr))
+	secondary := NewBroker(ClusterID(testClusterID), broker.Addrs(secondaryAddr))
+	m := NewMirroringBroker(primary, secondary, 16)
+	if err := m.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Disconnect()
+
+	subscribe := func(b broker.Broker) <-chan string {
+		ch := make(chan string, 1)
+		if _, err := b.Subscribe("test", func(e broker.Event) error {
+			ch <- string(e.Message().Body)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return ch
+	}
+	fromPrimary := subscribe(m)
+	fromSecondary := subscribe(secondary)
+
+	if err := m.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, fromPrimary); body != "hello" {
+		t.Errorf("Expected the primary to receive the message, got %q", body)
+	}
+	if body := receive(t, fromSecondary); body != "hello" {
+		t.Errorf("Expected the secondary to receive the message, got %q", body)
+	}
+
+	// a failing secondary doesn't fail the primary
+	if err := secondary.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Publish("test", &broker.Message{Body: []byte("again")}); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, fromPrimary); body != "again" {
+		t.Errorf("Expected the primary to receive the message, got %q", body)
+	}
+	if err := m.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.Dropped(); n != 1 {
+		t.Errorf("Expected 1 dropped copy, got %d", n)
+	}
+}
+
+func TestMirroringBrokerCopiesMessages(t *testing.T) {
+	primaryAddr, shutdownPrimary := runServer(t)
+	defer shutdownPrimary()
+	secondaryAddr, shutdownSecondary := runServer(t)
+	defer shutdownSecondary()
+
+	primary := NewBroker(ClusterID(testClusterID), broker.Addrs(primaryAddr))
+	secondary := NewBroker(ClusterID(testClusterID), broker.Addrs(secondaryAddr))
+	m := NewMirroringBroker(primary, secondary, 16)
+	if err := m.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Disconnect()
+
+	ch := make(chan string, 1)
+	if _, err := secondary.Subscribe("test", func(e broker.Event) error {
+		ch <- e.Message().Header["id"] + ":" + string(e.Message().Body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the message is reused right away while the copy is still queued
+	msg := &broker.Message{Header: map[string]string{"id": "1"}, Body: []byte("hello")}
+	if err := m.Publish("test", msg); err != nil {
+		t.Fatal(err)
+	}
+	msg.Header["id"] = "2"
+	copy(msg.Body, "world")
+
+	if got := receive(t, ch); got != "1:hello" {
+		t.Errorf("Expected the secondary to receive the published message, got %q", got)
+	}
+}
@@ -0,0 +1,156 @@
+package stan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+// ErrEmptyChannel is returned by Subscribe with FailIfEmpty for a replay of an empty channel
+var ErrEmptyChannel = errors.New("[stan]: channel is empty")
+
+var (
+	errNoMonitoring    = errors.New("[stan]: monitoring url not set, use the MonitoringURL option")
+	errMonitorNotFound = errors.New("[stan]: not found by the monitoring endpoint")
+)
+
+// monitorClient is used for requests to the monitoring endpoint
+var monitorClient = &http.Client{Timeout: 5 * time.Second}
+
+// channelLimitsz are the message limits reported by the monitoring endpoint
+type channelLimitsz struct {
+	MaxMsgs  int64         `json:"max_msgs"`
+	MaxBytes int64         `json:"max_bytes"`
+	MaxAge   time.Duration `json:"max_age"`
+}
+
+type channelz struct {
+	Msgs          uint64            `json:"msgs"`
+	Subscriptions []json.RawMessage `json:"subscriptions"`
+}
+
+type storez struct {
+	Limits struct {
+		channelLimitsz
+		PerChannel map[string]*channelLimitsz `json:"channels"`
+	} `json:"limits"`
+}
+
+// monitor decodes the response of the monitoring endpoint at path into v
+func (n *stanBroker) monitor(path string, query url.Values, v interface{}) error {
+	base, ok := n.opts.Context.Value(monitoringURLKey{}).(string)
+	if !ok || len(base) == 0 {
+		return errNoMonitoring
+	}
+
+	u := strings.TrimSuffix(base, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	rsp, err := monitorClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusNotFound {
+		return errMonitorNotFound
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("[stan]: monitoring endpoint %s returned %s", u, rsp.Status)
+	}
+	return json.NewDecoder(rsp.Body).Decode(v)
+}
+
+// ChannelLimits returns the message limits of a channel from the monitoring endpoint,
+// zero values mean unlimited. Consumers replaying a limited channel from the start
+// may miss messages that were already discarded.
+func (n *stanBroker) ChannelLimits(name string) (maxMsgs, maxBytes int64, maxAge time.Duration, err error) {
+	var s storez
+	if err = n.monitor("/streaming/storez", nil, &s); err != nil {
+		return
+	}
+
+	limits := &s.Limits.channelLimitsz
+	channel, ok := s.Limits.PerChannel[name]
+	if !ok {
+		channel = &channelLimitsz{}
+	}
+
+	// a per channel limit of zero inherits the global limit, a negative one is unlimited
+	pick := func(global, limit int64) int64 {
+		switch {
+		case limit < 0:
+			return 0
+		case limit > 0:
+			return limit
+		}
+		return global
+	}
+
+	maxMsgs = pick(limits.MaxMsgs, channel.MaxMsgs)
+	maxBytes = pick(limits.MaxBytes, channel.MaxBytes)
+	maxAge = time.Duration(pick(int64(limits.MaxAge), int64(channel.MaxAge)))
+	return
+}
+
+// ChannelMessages returns the number of messages stored in a channel from the
+// monitoring endpoint, a channel that doesn't exist yet has none
+func (n *stanBroker) ChannelMessages(name string) (uint64, error) {
+	var c channelz
+	err := n.monitor("/streaming/channelsz", url.Values{"channel": {name}}, &c)
+	if err == errMonitorNotFound {
+		return 0, nil
+	}
+	return c.Msgs, err
+}
+
+// channelSubscribers returns the number of subscriptions of a channel, offline
+// durables included, from the monitoring endpoint
+func (n *stanBroker) channelSubscribers(name string) (int, error) {
+	var c channelz
+	err := n.monitor("/streaming/channelsz", url.Values{"channel": {name}, "subs": {"1"}}, &c)
+	if err == errMonitorNotFound {
+		return 0, nil
+	}
+	return len(c.Subscriptions), err
+}
+
+// waitForSubscribers blocks until the channel has a subscriber or the timeout
+// elapses. Channels once seen with a subscriber aren't checked again.
+func (n *stanBroker) waitForSubscribers(topic string, timeout time.Duration) {
+	if _, ok := n.subscribed.Load(topic); ok {
+		return
+	}
+
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		subs, err := n.channelSubscribers(topic)
+		if err == nil && subs > 0 {
+			n.subscribed.Store(topic, struct{}{})
+			return
+		}
+		if err == errNoMonitoring {
+			n.logf(log.WarnLevel, "[stan]: can't wait for subscribers of %s: %v", topic, err)
+			return
+		}
+		select {
+		case <-deadline:
+			n.logf(log.WarnLevel, "[stan]: no subscriber of %s after %v, publishing anyway", topic, timeout)
+			return
+		case <-n.opts.Context.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
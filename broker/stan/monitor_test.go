@@ -0,0 +1,164 @@
+package stan
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	"github.com/nats-io/nats-streaming-server/stores"
+	stan "github.com/nats-io/stan.go"
+)
+
+func TestChannelLimits(t *testing.T) {
+	addr, murl, shutdown := runMonitoredServer(t, func(sopts *stand.Options) {
+		sopts.MaxMsgs = 100
+		sopts.MaxBytes = 0
+		sopts.MaxAge = 0
+		sopts.AddPerChannel("limited", &stores.ChannelLimits{
+			MsgStoreLimits: stores.MsgStoreLimits{MaxMsgs: 10, MaxAge: time.Hour},
+		})
+	})
+	defer shutdown()
+
+	b := newTestBroker(t, addr, MonitoringURL(murl))
+	defer b.Disconnect()
+
+	maxMsgs, maxBytes, maxAge, err := b.ChannelLimits("limited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxMsgs != 10 || maxBytes != 0 || maxAge != time.Hour {
+		t.Errorf("Expected per channel limits 10, 0, 1h, got %d, %d, %v", maxMsgs, maxBytes, maxAge)
+	}
+
+	maxMsgs, maxBytes, maxAge, err = b.ChannelLimits("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxMsgs != 100 || maxBytes != 0 || maxAge != 0 {
+		t.Errorf("Expected global limits 100, 0, 0, got %d, %d, %v", maxMsgs, maxBytes, maxAge)
+	}
+
+	// without the monitoring endpoint the limits are unknown
+	nb := newTestBroker(t, addr)
+	defer nb.Disconnect()
+	if _, _, _, err := nb.ChannelLimits("limited"); err != errNoMonitoring {
+		t.Errorf("Expected %v, got %v", errNoMonitoring, err)
+	}
+}
+
+func TestFailIfEmpty(t *testing.T) {
+	addr, murl, shutdown := runMonitoredServer(t, nil)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, MonitoringURL(murl))
+	defer b.Disconnect()
+
+	handler := func(broker.Event) error { return nil }
+	replay := SubscribeOption(stan.DeliverAllAvailable())
+
+	if _, err := b.Subscribe("empty", handler, FailIfEmpty(true), replay); err != ErrEmptyChannel {
+		t.Errorf("Expected %v for an empty channel, got %v", ErrEmptyChannel, err)
+	}
+	// new messages only don't need a backlog
+	if _, err := b.Subscribe("empty", handler, FailIfEmpty(true)); err != nil {
+		t.Errorf("Expected no error without replay, got %v", err)
+	}
+
+	if err := b.Publish("full", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b.ChannelMessages("full"); err != nil || n != 1 {
+		t.Errorf("Expected 1 message, got %d, %v", n, err)
+	}
+	if _, err := b.Subscribe("full", handler, FailIfEmpty(true), replay); err != nil {
+		t.Errorf("Expected no error for a channel with messages, got %v", err)
+	}
+}
+
+func TestCreateChannelsOnConnect(t *testing.T) {
+	addr, murl, shutdown := runMonitoredServer(t, nil)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, MonitoringURL(murl), ConnectRetry(true), Sign([]byte("key")), CreateChannelsOnConnect([]string{"warm"}))
+	defer b.Disconnect()
+
+	msgs, err := b.ChannelMessages("warm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs != 1 {
+		t.Fatalf("Expected the channel to exist with the sentinel, got %d messages", msgs)
+	}
+
+	// the sentinel is skipped even where empty payloads are allowed or signatures
+	// are required
+	ch := make(chan string, 2)
+	errs := make(chan error, 2)
+	if _, err := b.Subscribe("warm", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return e.Ack()
+	}, SubscribeOption(stan.DeliverAllAvailable()), broker.DisableAutoAck(), AllowEmptyPayloads(true), SubscribeErrorHandler(func(e broker.Event) error {
+		errs <- e.Error()
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("warm", &broker.Message{Body: []byte("first")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := receive(t, ch); body != "first" {
+		t.Errorf("Expected the sentinel to be skipped, got %q", body)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("Expected the sentinel not to fail, got %v", err)
+	default:
+	}
+
+	// a reconnect finds the channel created already
+	b.RLock()
+	conn := b.conn
+	b.RUnlock()
+	conn.Close()
+	b.connectionLost(conn, errors.New("connection lost"))
+	if msgs, err := b.ChannelMessages("warm"); err != nil || msgs != 2 {
+		t.Errorf("Expected no sentinel on reconnect, got %d messages, %v", msgs, err)
+	}
+}
+
+func TestWaitForSubscribers(t *testing.T) {
+	addr, murl, shutdown := runMonitoredServer(t, nil)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, MonitoringURL(murl), WaitForSubscribers(5*time.Second))
+	defer b.Disconnect()
+
+	sb := newTestBroker(t, addr)
+	defer sb.Disconnect()
+
+	ch := make(chan string, 1)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		if _, err := sb.Subscribe("late", func(e broker.Event) error {
+			ch <- string(e.Message().Body)
+			return nil
+		}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	start := time.Now()
+	if err := b.Publish("late", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected publish to wait for the subscriber, returned after %v", elapsed)
+	}
+	if body := receive(t, ch); body != "hello" {
+		t.Errorf("Expected the message to reach the late subscriber, got %q", body)
+	}
+}
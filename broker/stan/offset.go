@@ -0,0 +1,124 @@
+package stan
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/micro/go-micro/v2/broker"
+	stan "github.com/nats-io/stan.go"
+)
+
+var errNoOffsets = errors.New("[stan]: offsets require a manual ack subscription")
+
+// OffsetSubscriber is implemented by the subscribers of this broker, it offers Kafka
+// style offsets on top of acks and start positions. Subscribe returns it as a
+// broker.Subscriber, the offsets are only available in manual ack mode.
+type OffsetSubscriber interface {
+	broker.Subscriber
+	// Commit acks every received message up to seq, unacked messages are redelivered
+	// after a restart of a durable subscription
+	Commit(seq uint64) error
+	// Seek restarts the subscription at seq, uncommitted messages are discarded
+	Seek(seq uint64) error
+}
+
+// offsets tracks the received messages neither acked nor committed yet
+type offsets struct {
+	sync.Mutex
+	pending map[uint64]*stan.Msg
+}
+
+func newOffsets() *offsets {
+	return &offsets{pending: make(map[uint64]*stan.Msg)}
+}
+
+func (o *offsets) add(msg *stan.Msg) {
+	o.Lock()
+	o.pending[msg.Sequence] = msg
+	o.Unlock()
+}
+
+// acked removes a message acked by the handler
+func (o *offsets) acked(msg *stan.Msg) {
+	o.Lock()
+	delete(o.pending, msg.Sequence)
+	o.Unlock()
+}
+
+// commit removes and returns the pending messages up to seq
+func (o *offsets) commit(seq uint64) []*stan.Msg {
+	o.Lock()
+	defer o.Unlock()
+	var done []*stan.Msg
+	for s, msg := range o.pending {
+		if s <= seq {
+			done = append(done, msg)
+			delete(o.pending, s)
+		}
+	}
+	return done
+}
+
+// lowest returns the lowest pending sequence, if any
+func (o *offsets) lowest() (uint64, bool) {
+	o.Lock()
+	defer o.Unlock()
+	var low uint64
+	for s := range o.pending {
+		if low == 0 || s < low {
+			low = s
+		}
+	}
+	return low, low > 0
+}
+
+func (o *offsets) reset() {
+	o.Lock()
+	o.pending = make(map[uint64]*stan.Msg)
+	o.Unlock()
+}
+
+func (n *subscriber) Commit(seq uint64) error {
+	if n.offsets == nil {
+		return errNoOffsets
+	}
+	var err error
+	for _, msg := range n.offsets.commit(seq) {
+		if n.unacked != nil {
+			n.unacked.acked(msg)
+		}
+		if aerr := msg.Ack(); aerr != nil && err == nil {
+			err = aerr
+		}
+	}
+	return err
+}
+
+func (n *subscriber) Seek(seq uint64) error {
+	if n.offsets == nil {
+		return errNoOffsets
+	}
+	n.b.RLock()
+	conn := n.b.conn
+	n.b.RUnlock()
+	if conn == nil {
+		return errors.New("not connected")
+	}
+	n.offsets.reset()
+	return n.reset(conn, stan.StartAtSequence(seq))
+}
+
+// reset replaces the stan subscription by one created at start
+func (n *subscriber) reset(conn stan.Conn, start stan.SubscriptionOption) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.s.Unsubscribe(); err != nil {
+		return err
+	}
+	sub, err := n.subscribe(conn, start)
+	if err != nil {
+		return err
+	}
+	n.s = sub
+	return nil
+}
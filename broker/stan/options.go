@@ -2,20 +2,59 @@ package stan
 
 import (
 	"context"
+	"net"
 	"time"
 
 	"github.com/micro/go-micro/v2/broker"
+	"github.com/micro/go-micro/v2/logger"
 	"github.com/micro/go-micro/v2/server"
+	nats "github.com/nats-io/nats.go"
 	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
 )
 
 type optionsKey struct{}
 
-// Options accepts stan.Options
+// Options accepts stan.Options. They are applied with a fixed precedence: the stan
+// defaults, then the non zero fields of opts, then the typed options like ConnectWait
+// or broker.Addrs, which override the NatsURL.
 func Options(opts stan.Options) broker.Option {
 	return setBrokerOption(optionsKey{}, opts)
 }
 
+// mergeStanOptions returns the stan defaults overridden by the non zero fields of raw
+func mergeStanOptions(raw stan.Options) stan.Options {
+	opts := stan.GetDefaultOptions()
+	if len(raw.NatsURL) > 0 {
+		opts.NatsURL = raw.NatsURL
+	}
+	if raw.NatsConn != nil {
+		opts.NatsConn = raw.NatsConn
+	}
+	if raw.ConnectTimeout > 0 {
+		opts.ConnectTimeout = raw.ConnectTimeout
+	}
+	if raw.AckTimeout > 0 {
+		opts.AckTimeout = raw.AckTimeout
+	}
+	if len(raw.DiscoverPrefix) > 0 {
+		opts.DiscoverPrefix = raw.DiscoverPrefix
+	}
+	if raw.MaxPubAcksInflight > 0 {
+		opts.MaxPubAcksInflight = raw.MaxPubAcksInflight
+	}
+	if raw.PingInterval > 0 {
+		opts.PingInterval = raw.PingInterval
+	}
+	if raw.PingMaxOut > 0 {
+		opts.PingMaxOut = raw.PingMaxOut
+	}
+	if raw.ConnectionLostCB != nil {
+		opts.ConnectionLostCB = raw.ConnectionLostCB
+	}
+	return opts
+}
+
 type clusterIDKey struct{}
 
 // ClusterID specify cluster id to connect
@@ -40,6 +79,95 @@ func ServerSubscriberOption(opts ...stan.SubscriptionOption) server.SubscriberOp
 	return setServerSubscriberOption(subscribeOptionKey{}, opts)
 }
 
+// SubOptsBuilder is a typed builder for stan subscription options
+type SubOptsBuilder struct {
+	queue string
+	opts  []stan.SubscriptionOption
+}
+
+// SubscribeOptions returns a builder producing a broker.SubscribeOption from typed stan options
+func SubscribeOptions() *SubOptsBuilder {
+	return &SubOptsBuilder{}
+}
+
+// Durable sets the durable name of the subscription
+func (b *SubOptsBuilder) Durable(name string) *SubOptsBuilder {
+	b.opts = append(b.opts, stan.DurableName(name))
+	return b
+}
+
+// Queue sets the queue group of the subscription
+func (b *SubOptsBuilder) Queue(name string) *SubOptsBuilder {
+	b.queue = name
+	return b
+}
+
+// MaxInflight sets the number of messages the cluster will have inflight without an ack
+func (b *SubOptsBuilder) MaxInflight(n int) *SubOptsBuilder {
+	b.opts = append(b.opts, stan.MaxInflight(n))
+	return b
+}
+
+// AckWait sets the time the cluster will wait for an ack before redelivering
+func (b *SubOptsBuilder) AckWait(td time.Duration) *SubOptsBuilder {
+	b.opts = append(b.opts, stan.AckWait(td))
+	return b
+}
+
+// StartAt sets the start position of the subscription
+func (b *SubOptsBuilder) StartAt(sp pb.StartPosition) *SubOptsBuilder {
+	b.opts = append(b.opts, stan.StartAt(sp))
+	return b
+}
+
+// StartAtSequence starts the subscription at the given sequence
+func (b *SubOptsBuilder) StartAtSequence(seq uint64) *SubOptsBuilder {
+	b.opts = append(b.opts, stan.StartAtSequence(seq))
+	return b
+}
+
+// StartAtTime starts the subscription at the given time
+func (b *SubOptsBuilder) StartAtTime(t time.Time) *SubOptsBuilder {
+	b.opts = append(b.opts, stan.StartAtTime(t))
+	return b
+}
+
+// StartAtTimeDelta starts the subscription at the given duration in the past
+func (b *SubOptsBuilder) StartAtTimeDelta(ago time.Duration) *SubOptsBuilder {
+	b.opts = append(b.opts, stan.StartAtTimeDelta(ago))
+	return b
+}
+
+// StartWithLastReceived starts the subscription with the last received message
+func (b *SubOptsBuilder) StartWithLastReceived() *SubOptsBuilder {
+	b.opts = append(b.opts, stan.StartWithLastReceived())
+	return b
+}
+
+// DeliverAllAvailable starts the subscription with the first available message
+func (b *SubOptsBuilder) DeliverAllAvailable() *SubOptsBuilder {
+	b.opts = append(b.opts, stan.DeliverAllAvailable())
+	return b
+}
+
+// ManualAck enables manual ack mode for the subscription
+func (b *SubOptsBuilder) ManualAck() *SubOptsBuilder {
+	b.opts = append(b.opts, stan.SetManualAckMode())
+	return b
+}
+
+// Build returns the broker.SubscribeOption carrying the collected options
+func (b *SubOptsBuilder) Build() broker.SubscribeOption {
+	queue := b.queue
+	opts := append([]stan.SubscriptionOption(nil), b.opts...)
+	return func(o *broker.SubscribeOptions) {
+		if len(queue) > 0 {
+			o.Queue = queue
+		}
+		SubscribeOption(opts...)(o)
+	}
+}
+
 type subscribeContextKey struct{}
 
 // SubscribeContext set the context for broker.SubscribeOption
@@ -61,6 +189,22 @@ func ConnectTimeout(td time.Duration) broker.Option {
 	return setBrokerOption(connectTimeoutKey{}, td)
 }
 
+type maxConnectDurationKey struct{}
+
+// MaxConnectDuration is a hard ceiling for connecting, unlike ConnectTimeout it is
+// enforced within attempts, which are shortened to the time left before it
+func MaxConnectDuration(td time.Duration) broker.Option {
+	return setBrokerOption(maxConnectDurationKey{}, td)
+}
+
+type connectWaitKey struct{}
+
+// ConnectWait sets how long the handshake with the streaming server waits, it
+// overrides the ConnectTimeout of the stan.Options
+func ConnectWait(td time.Duration) broker.Option {
+	return setBrokerOption(connectWaitKey{}, td)
+}
+
 type connectRetryKey struct{}
 
 // ConnectRetry reconnect to broker in case of errors
@@ -74,3 +218,673 @@ type durableKey struct{}
 func DurableName(name string) broker.Option {
 	return setBrokerOption(durableKey{}, name)
 }
+
+// PublishFunc publishes a message to a topic
+type PublishFunc func(topic string, msg *broker.Message, opts ...broker.PublishOption) error
+
+// PublishWrapper wraps a PublishFunc to add cross-cutting behaviour to every publish
+type PublishWrapper func(next PublishFunc) PublishFunc
+
+type publishMiddlewareKey struct{}
+
+// PublishMiddleware sets the middleware chain applied around every publish,
+// the first middleware is the outermost
+func PublishMiddleware(mws ...PublishWrapper) broker.Option {
+	return setBrokerOption(publishMiddlewareKey{}, mws)
+}
+
+type encryptionKey struct{}
+
+type encryption struct {
+	key  []byte
+	algo string
+}
+
+// Encryption encrypts message payloads with the given key before publishing and
+// decrypts them on receive. Only "aes-gcm" is supported, the key length selects
+// AES-128, AES-192 or AES-256. All producers and consumers of a channel must share the key.
+func Encryption(key []byte, algo string) broker.Option {
+	return setBrokerOption(encryptionKey{}, encryption{key: key, algo: algo})
+}
+
+type latestPerKeyKey struct{}
+
+// LatestPerKey compacts replayed messages client side, only the latest message for
+// each key returned by keyFunc is passed to the handler. Messages stored before the
+// subscription was created are treated as replay, the compacted batch is delivered
+// once the first live message arrives or the replay goes idle. Superseded messages
+// are acked, in auto ack mode buffered messages are acked once handled.
+func LatestPerKey(keyFunc func(*broker.Message) string) broker.SubscribeOption {
+	return setSubscribeOption(latestPerKeyKey{}, keyFunc)
+}
+
+type orderedRedeliveryKey struct{}
+
+// OrderedRedelivery reorders messages by sequence when redelivered messages interleave
+// with new ones, e.g. after a reconnect. Once a redelivery is seen all messages are
+// buffered in memory until the catch-up goes idle, so a large backlog of in-flight
+// messages is held in memory and delivery is delayed for the catch-up window. In auto
+// ack mode buffered messages are acked once handled.
+func OrderedRedelivery(b bool) broker.SubscribeOption {
+	return setSubscribeOption(orderedRedeliveryKey{}, b)
+}
+
+type controlMessageKey struct{}
+
+// OnControlMessage sets a callback for header only messages, received messages
+// with an empty body are passed to it instead of the subscription handler
+func OnControlMessage(fn func(header map[string]string)) broker.SubscribeOption {
+	return setSubscribeOption(controlMessageKey{}, fn)
+}
+
+type workersKey struct{}
+
+// Workers runs the handler on a pool of n goroutines instead of the stan delivery goroutine
+func Workers(n int) broker.SubscribeOption {
+	return setSubscribeOption(workersKey{}, n)
+}
+
+type queueWorkersKey struct{}
+
+// QueueWorkers bounds the concurrent handlers of a queue group member to n, taking
+// precedence over Workers, e.g. ones set by DefaultSubscribeOptions. It has no effect
+// on subscriptions without a queue.
+func QueueWorkers(n int) broker.SubscribeOption {
+	return setSubscribeOption(queueWorkersKey{}, n)
+}
+
+// AckMode controls when messages handled by a worker pool are acked
+type AckMode int
+
+const (
+	// OnComplete acks once the handler returns, a handler that never completes
+	// gets its message redelivered, preserving at-least-once delivery
+	OnComplete AckMode = iota
+	// OnDispatch acks when the message is handed to a worker, giving higher
+	// throughput at the risk of losing messages if the handler fails (at-most-once)
+	OnDispatch
+)
+
+type workerAckModeKey struct{}
+
+// WorkerAckMode sets when messages handled by the Workers pool are acked, defaults to OnComplete
+func WorkerAckMode(mode AckMode) broker.SubscribeOption {
+	return setSubscribeOption(workerAckModeKey{}, mode)
+}
+
+type tracerKey struct{}
+
+// Tracing starts spans around publish and the subscription handler, propagating
+// the trace through the message header. Tracing is disabled when unset.
+func Tracing(t Tracer) broker.Option {
+	return setBrokerOption(tracerKey{}, t)
+}
+
+type handlerTimeoutKey struct{}
+
+// HandlerTimeout bounds the handler execution, the deadline is available to the
+// handler through EventContext. Timed out messages are not acked so they are
+// redelivered, and ErrHandlerTimeout is passed to the error handler.
+func HandlerTimeout(td time.Duration) broker.SubscribeOption {
+	return setSubscribeOption(handlerTimeoutKey{}, td)
+}
+
+// StartPosition sets where a subscription starts delivering messages
+type StartPosition stan.SubscriptionOption
+
+// StartAtSequence starts at the given sequence
+func StartAtSequence(seq uint64) StartPosition {
+	return StartPosition(stan.StartAtSequence(seq))
+}
+
+// StartAtTime starts at the first message stored at or after the given time
+func StartAtTime(t time.Time) StartPosition {
+	return StartPosition(stan.StartAtTime(t))
+}
+
+// StartAtTimeDelta starts at the first message stored within the given duration
+func StartAtTimeDelta(ago time.Duration) StartPosition {
+	return StartPosition(stan.StartAtTimeDelta(ago))
+}
+
+// StartWithLastReceived starts with the last stored message
+func StartWithLastReceived() StartPosition {
+	return StartPosition(stan.StartWithLastReceived())
+}
+
+// DeliverAllAvailable starts with the first stored message
+func DeliverAllAvailable() StartPosition {
+	return StartPosition(stan.DeliverAllAvailable())
+}
+
+type compressThresholdKey struct{}
+
+// CompressThreshold gzips payloads larger than the given number of bytes, smaller
+// payloads are sent as is. Every payload is prefixed with a flag byte telling whether
+// it's compressed, so consumers must enable compression as well, with any threshold.
+func CompressThreshold(bytes int) broker.Option {
+	return setBrokerOption(compressThresholdKey{}, bytes)
+}
+
+type retryHandlerKey struct{}
+
+type retry struct {
+	attempts int
+	backoff  time.Duration
+}
+
+// RetryHandler invokes a failing handler up to attempts times in process, doubling
+// the backoff after each failure, before the error is returned and redelivery takes over
+func RetryHandler(attempts int, backoff time.Duration) broker.SubscribeOption {
+	return setSubscribeOption(retryHandlerKey{}, retry{attempts: attempts, backoff: backoff})
+}
+
+type subscribeErrorHandlerKey struct{}
+
+// SubscribeErrorHandler sets the error handler of a subscription, overriding broker.ErrorHandler
+func SubscribeErrorHandler(h broker.Handler) broker.SubscribeOption {
+	return setSubscribeOption(subscribeErrorHandlerKey{}, h)
+}
+
+type defaultSubscribeOptionsKey struct{}
+
+// DefaultSubscribeOptions sets options applied to every Subscribe, options passed
+// to Subscribe are applied after them and take precedence
+func DefaultSubscribeOptions(opts ...broker.SubscribeOption) broker.Option {
+	return setBrokerOption(defaultSubscribeOptionsKey{}, opts)
+}
+
+type monitoringURLKey struct{}
+
+// MonitoringURL sets the http monitoring endpoint of the streaming server, e.g. http://localhost:8222
+func MonitoringURL(url string) broker.Option {
+	return setBrokerOption(monitoringURLKey{}, url)
+}
+
+type matchHeadersKey struct{}
+
+// MatchHeaders only passes messages carrying all the given header values to the
+// handler, other messages are acked and skipped
+func MatchHeaders(headers map[string]string) broker.SubscribeOption {
+	return setSubscribeOption(matchHeadersKey{}, headers)
+}
+
+type resumeAtLatestKey struct{}
+
+// ResumeAtLatest makes a durable subscription resume at the last message of the
+// channel instead of where it left off. Messages published while the durable was
+// offline, other than the last one, are never delivered so at-least-once delivery
+// does not hold for them.
+func ResumeAtLatest(b bool) broker.SubscribeOption {
+	return setSubscribeOption(resumeAtLatestKey{}, b)
+}
+
+type circuitBreakerKey struct{}
+
+type circuitBreaker struct {
+	failures int
+	reset    time.Duration
+}
+
+// CircuitBreaker fails publishes fast with ErrCircuitOpen after the given number of
+// consecutive failures, a trial publish is allowed once the reset window elapsed
+func CircuitBreaker(failures int, reset time.Duration) broker.Option {
+	return setBrokerOption(circuitBreakerKey{}, circuitBreaker{failures: failures, reset: reset})
+}
+
+type readinessKey struct{}
+
+// Readiness sets a callback invoked whenever the broker becomes ready or not ready,
+// on connect, disconnect, connection loss and reconnect
+func Readiness(fn func(ready bool)) broker.Option {
+	return setBrokerOption(readinessKey{}, fn)
+}
+
+type respectTTLKey struct{}
+
+// RespectTTL drops messages whose ExpiresHeader has passed without calling the
+// handler, dropped messages are acked
+func RespectTTL(b bool) broker.SubscribeOption {
+	return setSubscribeOption(respectTTLKey{}, b)
+}
+
+type checkpointKey struct{}
+
+// Checkpoint resumes the subscription after the sequence stored in the CheckpointStore
+// and saves the highest sequence up to which the handler completed every message, so
+// handlers finishing out of order with Workers never move it backwards
+func Checkpoint(store CheckpointStore) broker.SubscribeOption {
+	return setSubscribeOption(checkpointKey{}, store)
+}
+
+type deadLetterKey struct{}
+
+// DeadLetter publishes messages whose handler returned a PermanentError to topic
+// before acking them
+func DeadLetter(topic string) broker.SubscribeOption {
+	return setSubscribeOption(deadLetterKey{}, topic)
+}
+
+type loggerKey struct{}
+
+// Logger sets the logger used by the broker instead of the default logger
+func Logger(l logger.Logger) broker.Option {
+	return setBrokerOption(loggerKey{}, l)
+}
+
+type logLevelKey struct{}
+
+// LogLevel sets the minimum level of the broker's log entries. Failed connect attempts
+// are logged at debug level, giving up connecting at error level.
+func LogLevel(level logger.Level) broker.Option {
+	return setBrokerOption(logLevelKey{}, level)
+}
+
+type signKey struct{}
+
+// Sign appends an HMAC-SHA256 of the payload on publish and verifies it on receive.
+// Messages failing verification are passed to the error handler with
+// ErrInvalidSignature and acked. All publishers and subscribers need the same key.
+func Sign(hmacKey []byte) broker.Option {
+	return setBrokerOption(signKey{}, hmacKey)
+}
+
+type backlogWindowKey struct{}
+
+// BacklogWindow replays the messages of the last d before going live. Replayed
+// messages that become older than d while catching up are acked and skipped.
+func BacklogWindow(d time.Duration) broker.SubscribeOption {
+	return setSubscribeOption(backlogWindowKey{}, d)
+}
+
+type maxMessageAgeKey struct{}
+
+// MaxMessageAge acks and skips messages published more than d ago before they are
+// decoded, e.g. the stale part of the backlog a durable replays after an outage
+func MaxMessageAge(d time.Duration) broker.SubscribeOption {
+	return setSubscribeOption(maxMessageAgeKey{}, d)
+}
+
+type codecCheckKey struct{}
+
+// CodecCheck reports a likely codec mismatch if the first message received fails to
+// decode, using the OnCodecMismatch callback or a warning. The message is handled like
+// any message that fails to decode.
+func CodecCheck(b bool) broker.SubscribeOption {
+	return setSubscribeOption(codecCheckKey{}, b)
+}
+
+type codecMismatchKey struct{}
+
+// OnCodecMismatch sets the callback of CodecCheck
+func OnCodecMismatch(fn func(topic string, err error)) broker.SubscribeOption {
+	return setSubscribeOption(codecMismatchKey{}, fn)
+}
+
+type maxReceiveSizeKey struct{}
+
+// MaxReceiveSize acks messages with a payload larger than bytes without decoding
+// them and passes them to the error handler with ErrMessageTooLarge, e.g. for
+// producers outside go-micro that ignore the publish limits
+func MaxReceiveSize(bytes int) broker.SubscribeOption {
+	return setSubscribeOption(maxReceiveSizeKey{}, bytes)
+}
+
+type allowEmptyPayloadsKey struct{}
+
+// AllowEmptyPayloads passes messages with an empty payload to the handler as empty
+// messages, by default they are treated as keepalives, acked and skipped.
+func AllowEmptyPayloads(b bool) broker.SubscribeOption {
+	return setSubscribeOption(allowEmptyPayloadsKey{}, b)
+}
+
+type headerSubjectKey struct{}
+
+// AppendHeaderToSubject publishes to the topic followed by the value of the header as
+// an additional subject token, e.g. orders.eu for the header value eu. Publishing
+// fails if the value is empty or contains '.', '*', '>' or whitespace.
+func AppendHeaderToSubject(headerKey string) broker.PublishOption {
+	return setPublishOption(headerSubjectKey{}, headerKey)
+}
+
+type connectionLostKey struct{}
+
+// OnConnectionLost sets a callback invoked when the connection is lost, intentional
+// is true if it was closed by Disconnect and false if it was lost unexpectedly
+func OnConnectionLost(fn func(err error, intentional bool)) broker.Option {
+	return setBrokerOption(connectionLostKey{}, fn)
+}
+
+type pingFailureKey struct{}
+
+// OnPingFailure sets a callback invoked when the connection is lost because the
+// server didn't answer the maximum number of pings, as opposed to a closed connection.
+// It is called before OnConnectionLost.
+func OnPingFailure(fn func(err error)) broker.Option {
+	return setBrokerOption(pingFailureKey{}, fn)
+}
+
+type reconnectGraceKey struct{}
+
+// ReconnectGrace keeps the broker reported ready for d after losing the connection,
+// it only becomes not ready if no reconnect succeeded in the meantime
+func ReconnectGrace(d time.Duration) broker.Option {
+	return setBrokerOption(reconnectGraceKey{}, d)
+}
+
+type ackBatchKey struct{}
+
+type ackBatch struct {
+	window time.Duration
+	size   int
+}
+
+// AckBatch collects the acks of a manual ack subscription and sends them once size
+// acks are pending or every window, the window should be well below the AckWait.
+// Pending acks are sent when the subscription is unsubscribed, closed or drained.
+func AckBatch(window time.Duration, size int) broker.SubscribeOption {
+	return setSubscribeOption(ackBatchKey{}, ackBatch{window: window, size: size})
+}
+
+type natsNoRandomizeKey struct{}
+
+// NatsNoRandomize connects to the nats servers in the configured order instead of a
+// random one, for deterministic primary and failover servers
+func NatsNoRandomize(b bool) broker.Option {
+	return setBrokerOption(natsNoRandomizeKey{}, b)
+}
+
+type proxyDialerKey struct{}
+
+// ProxyDialer opens the connections to the nats servers with dial, e.g. to connect
+// through a SOCKS or HTTP proxy. It doesn't apply to a custom NatsConn.
+func ProxyDialer(dial func(network, addr string) (net.Conn, error)) broker.Option {
+	return setBrokerOption(proxyDialerKey{}, dial)
+}
+
+type natsOptionsKey struct{}
+
+// NatsOptions appends opts to the options of the nats connection, after the ones set
+// by the broker so they take precedence. It doesn't apply to a custom NatsConn.
+func NatsOptions(opts ...nats.Option) broker.Option {
+	return setBrokerOption(natsOptionsKey{}, opts)
+}
+
+type flushTimeoutKey struct{}
+
+// FlushTimeout bounds how long the nats connection waits to write buffered data
+// before it considers the connection stale. It doesn't apply to a custom NatsConn.
+func FlushTimeout(td time.Duration) broker.Option {
+	return setBrokerOption(flushTimeoutKey{}, td)
+}
+
+type natsPingIntervalKey struct{}
+
+// NatsPingInterval sets the interval of the nats connection pings, the connection is
+// considered lost once two pings are unanswered, i.e. after about twice the interval.
+// Unlike the stan Pings, which check the streaming server, it detects a broken link
+// to the nats server. It doesn't apply to a custom NatsConn.
+func NatsPingInterval(td time.Duration) broker.Option {
+	return setBrokerOption(natsPingIntervalKey{}, td)
+}
+
+type postConnectKey struct{}
+
+// PostConnect sets a hook invoked with the new connection after every successful
+// connect and reconnect, e.g. to prime channels. An error closes the connection and
+// fails the connect, a reconnect retries until the hook succeeds.
+func PostConnect(fn func(conn stan.Conn) error) broker.Option {
+	return setBrokerOption(postConnectKey{}, fn)
+}
+
+type logSubscriptionEventsKey struct{}
+
+// LogSubscriptionEvents logs subscribing, unsubscribing and closing as well as the
+// ack, nak or error outcome of every message at info level. Entries carry the event,
+// topic, queue, durable name and sequence as logger fields.
+func LogSubscriptionEvents(b bool) broker.Option {
+	return setBrokerOption(logSubscriptionEventsKey{}, b)
+}
+
+type extractSubjectTokensKey struct{}
+
+// ExtractSubjectTokens copies the subject tokens named in pattern to the message
+// header, e.g. the pattern events.<tenant>.<type> sets the tenant and type headers.
+// Literal tokens of the pattern must match the subject.
+func ExtractSubjectTokens(pattern string) broker.SubscribeOption {
+	return setSubscribeOption(extractSubjectTokensKey{}, pattern)
+}
+
+type failIfEmptyKey struct{}
+
+// FailIfEmpty makes Subscribe fail with ErrEmptyChannel if a replay start position
+// is set and the channel has no messages. It requires the MonitoringURL option.
+func FailIfEmpty(b bool) broker.SubscribeOption {
+	return setSubscribeOption(failIfEmptyKey{}, b)
+}
+
+type publishConnsKey struct{}
+
+// PublishConns publishes over a pool of n additional connections used round robin,
+// subscriptions keep using the main connection
+func PublishConns(n int) broker.Option {
+	return setBrokerOption(publishConnsKey{}, n)
+}
+
+type addressWeightsKey struct{}
+
+// AddressWeights spreads the PublishConns connections over the broker addresses in
+// proportion to the weights, e.g. to prefer servers in the local data center.
+// Addresses without a weight count 1, ones with a weight of 0 get no connection.
+func AddressWeights(weights map[string]int) broker.Option {
+	return setBrokerOption(addressWeightsKey{}, weights)
+}
+
+type rawHandlerKey struct{}
+
+// RawHandler passes the undecoded stan messages to h instead of the broker.Handler,
+// which may then be nil. Decoding, filtering and the handler wrappers are bypassed,
+// in manual ack mode h acks the messages itself.
+func RawHandler(h func(*stan.Msg) error) broker.SubscribeOption {
+	return setSubscribeOption(rawHandlerKey{}, h)
+}
+
+type publishRateLimitKey struct{}
+
+type rateLimit struct {
+	rps   int
+	burst int
+}
+
+// PublishRateLimit caps the publish rate of the broker at rps with bursts of up to
+// burst messages, publishes exceeding it block until they are within the rate
+func PublishRateLimit(rps int, burst int) broker.Option {
+	return setBrokerOption(publishRateLimitKey{}, rateLimit{rps: rps, burst: burst})
+}
+
+type failOnRateLimitKey struct{}
+
+// FailOnRateLimit fails publishes exceeding the PublishRateLimit with ErrRateLimited
+// instead of blocking them
+func FailOnRateLimit(b bool) broker.Option {
+	return setBrokerOption(failOnRateLimitKey{}, b)
+}
+
+type subjectNamerKey struct{}
+
+// SubjectNaming maps every topic published or subscribed to through namer
+func SubjectNaming(namer SubjectNamer) broker.Option {
+	return setBrokerOption(subjectNamerKey{}, namer)
+}
+
+type systemErrorTopicKey struct{}
+
+// SystemErrorTopic publishes an ErrorRecord to topic whenever a handler fails or a
+// message can't be decoded, giving a cluster wide error feed
+func SystemErrorTopic(topic string) broker.Option {
+	return setBrokerOption(systemErrorTopicKey{}, topic)
+}
+
+type atMostOnceKey struct{}
+
+// AtMostOnce acks every message on receive, before the handler runs. A handler
+// that fails or crashes doesn't get its message redelivered, so messages can be
+// lost but are never handled twice. Handler acks have no effect in this mode.
+func AtMostOnce(b bool) broker.SubscribeOption {
+	return setSubscribeOption(atMostOnceKey{}, b)
+}
+
+type detectGapsKey struct{}
+
+// DetectGaps calls fn when a received sequence doesn't follow the previous one, e.g.
+// because a limited channel discarded messages before they were delivered. It is
+// meant for single consumers, queue group members receive a share of the sequences.
+func DetectGaps(fn func(expected, got uint64)) broker.SubscribeOption {
+	return setSubscribeOption(detectGapsKey{}, fn)
+}
+
+type decodeFuncKey struct{}
+
+// DecodeFunc decodes received payloads with fn instead of the codec, e.g. to choose
+// a schema by subject. Signature verification, decryption and decompression are
+// applied before fn.
+func DecodeFunc(fn func(subject string, data []byte) (*broker.Message, error)) broker.SubscribeOption {
+	return setSubscribeOption(decodeFuncKey{}, fn)
+}
+
+// ReliabilityLevel selects the delivery guarantee of a publish
+type ReliabilityLevel int
+
+const (
+	// PublishAtLeastOnce waits for the server to ack the message, the default
+	PublishAtLeastOnce ReliabilityLevel = iota
+	// PublishAtMostOnce returns once the message is sent without waiting for the
+	// ack, a message the server doesn't store is lost
+	PublishAtMostOnce
+)
+
+type reliabilityKey struct{}
+
+// Reliability sets the delivery guarantee of a single publish, trading durability
+// for latency with PublishAtMostOnce
+func Reliability(level ReliabilityLevel) broker.PublishOption {
+	return setPublishOption(reliabilityKey{}, level)
+}
+
+type coalescePublishKey struct{}
+
+// CoalescePublish buffers publishes per topic and sends only the latest one once per
+// window, for state updates where the latest value wins. Intermediate messages are
+// dropped, Publish returns before the message is sent and failures are only logged.
+// Pending messages are sent on Disconnect.
+func CoalescePublish(window time.Duration) broker.Option {
+	return setBrokerOption(coalescePublishKey{}, window)
+}
+
+type defaultTopicKey struct{}
+
+// DefaultTopic is published to when Publish is called with an empty topic
+func DefaultTopic(topic string) broker.Option {
+	return setBrokerOption(defaultTopicKey{}, topic)
+}
+
+type resultSubjectKey struct{}
+
+// ResultSubject publishes the ResultRecord of every PullSubscriber.AckWithResult to
+// subject, e.g. for auditing
+func ResultSubject(subject string) broker.SubscribeOption {
+	return setSubscribeOption(resultSubjectKey{}, subject)
+}
+
+type shardsKey struct{}
+
+// Shards sets the number of subjects ShardedPublish and ShardedSubscribe spread a
+// topic over
+func Shards(n int) broker.Option {
+	return setBrokerOption(shardsKey{}, n)
+}
+
+type waitForSubscribersKey struct{}
+
+// WaitForSubscribers blocks a publish to a channel without subscribers until one
+// subscribes or the timeout elapses, the message is published either way. The
+// subscribers are looked up with the monitoring endpoint set by MonitoringURL, a
+// channel is no longer checked once it had a subscriber.
+func WaitForSubscribers(timeout time.Duration) broker.Option {
+	return setBrokerOption(waitForSubscribersKey{}, timeout)
+}
+
+type createChannelsKey struct{}
+
+// CreateChannelsOnConnect publishes a sentinel to each of channels after Connect,
+// creating channels that don't exist yet, reconnects don't publish them again.
+// Subscribers always ack and skip the sentinels, one is stored per Connect and counts
+// against the channel limits.
+func CreateChannelsOnConnect(channels []string) broker.Option {
+	return setBrokerOption(createChannelsKey{}, channels)
+}
+
+type exclusiveHeartbeatKey struct{}
+
+// ExclusiveHeartbeat sets the heartbeat interval of ExclusiveSubscribe, an instance
+// missing three heartbeats is replaced. The default is a second.
+func ExclusiveHeartbeat(d time.Duration) broker.SubscribeOption {
+	return setSubscribeOption(exclusiveHeartbeatKey{}, d)
+}
+
+type compactHeadersKey struct{}
+
+// CompactHeaders encodes published messages as a binary block of length prefixed
+// headers followed by the raw body instead of the codec envelope, shrinking small
+// bodies with many headers. Payloads are prefixed with a flag byte, consumers with
+// the option decode both forms, so enable it on consumers first.
+func CompactHeaders(b bool) broker.Option {
+	return setBrokerOption(compactHeadersKey{}, b)
+}
+
+type lagAlertKey struct{}
+
+// LagAlert samples the messages waiting for the handler and calls cb when they
+// exceed threshold, e.g. to trigger scaling out. It fires once per crossing and
+// again after the backlog fell back to the threshold.
+func LagAlert(threshold int, cb func(pending int)) broker.SubscribeOption {
+	return setSubscribeOption(lagAlertKey{}, lagAlert{threshold: threshold, cb: cb})
+}
+
+type deduplicatePublishKey struct{}
+
+type deduplicate struct {
+	window time.Duration
+	size   int
+}
+
+// DeduplicatePublish skips publishing a message whose MessageIDHeader was published
+// within window, e.g. by a retry after a lost ack. Up to size ids are remembered,
+// the oldest are forgotten first. A failed publish doesn't count.
+func DeduplicatePublish(window time.Duration, size int) broker.Option {
+	return setBrokerOption(deduplicatePublishKey{}, deduplicate{window: window, size: size})
+}
+
+type metricsKey struct{}
+
+// Metrics reports the message counters of every subscription to c, labelled by
+// topic. Metrics are disabled when unset.
+func Metrics(c MetricsCollector) broker.Option {
+	return setBrokerOption(metricsKey{}, c)
+}
+
+type metricLabelsKey struct{}
+
+// MetricLabels adds labels to the metrics of the subscription, e.g. the consumer
+// name or team, so dashboards can tell subscriptions to the same topic apart
+func MetricLabels(labels map[string]string) broker.SubscribeOption {
+	return setSubscribeOption(metricLabelsKey{}, labels)
+}
+
+type replayIdleKey struct{}
+
+// ReplayIdle sets how long ReplayRange waits for the next message before it gives up
+// with a ReplayIncompleteError, one second by default
+func ReplayIdle(d time.Duration) broker.Option {
+	return setBrokerOption(replayIdleKey{}, d)
+}
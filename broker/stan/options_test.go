@@ -0,0 +1,122 @@
+package stan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+)
+
+func TestSubOptsBuilder(t *testing.T) {
+	opt := broker.NewSubscribeOptions(
+		SubscribeOptions().
+			Durable("durable").
+			Queue("queue").
+			MaxInflight(10).
+			AckWait(5 * time.Second).
+			StartAtSequence(42).
+			ManualAck().
+			Build(),
+	)
+
+	if opt.Queue != "queue" {
+		t.Errorf("Expected queue %q, got %q", "queue", opt.Queue)
+	}
+
+	subOpts, ok := opt.Context.Value(subscribeOptionKey{}).([]stan.SubscriptionOption)
+	if !ok {
+		t.Fatal("Expected stan subscription options to be set")
+	}
+
+	sopts := stan.DefaultSubscriptionOptions
+	for _, o := range subOpts {
+		if err := o(&sopts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if sopts.DurableName != "durable" {
+		t.Errorf("Expected durable name %q, got %q", "durable", sopts.DurableName)
+	}
+	if sopts.MaxInflight != 10 {
+		t.Errorf("Expected max inflight 10, got %d", sopts.MaxInflight)
+	}
+	if sopts.AckWait != 5*time.Second {
+		t.Errorf("Expected ack wait 5s, got %v", sopts.AckWait)
+	}
+	if sopts.StartAt != pb.StartPosition_SequenceStart || sopts.StartSequence != 42 {
+		t.Errorf("Expected start at sequence 42, got %v %d", sopts.StartAt, sopts.StartSequence)
+	}
+	if !sopts.ManualAcks {
+		t.Error("Expected manual ack mode")
+	}
+}
+
+func TestStanOptionsPrecedence(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	defaults := stan.GetDefaultOptions()
+	testCases := []struct {
+		name string
+		opts []broker.Option
+		// expected connect wait, publish ack wait and max publish acks in flight
+		connectWait time.Duration
+		ackWait     time.Duration
+		inflight    int
+	}{
+		{
+			name:        "defaults",
+			connectWait: defaults.ConnectTimeout,
+			ackWait:     defaults.AckTimeout,
+			inflight:    defaults.MaxPubAcksInflight,
+		},
+		{
+			name:        "raw options override defaults, zero fields keep them",
+			opts:        []broker.Option{Options(stan.Options{AckTimeout: 3 * time.Second})},
+			connectWait: defaults.ConnectTimeout,
+			ackWait:     3 * time.Second,
+			inflight:    defaults.MaxPubAcksInflight,
+		},
+		{
+			name: "typed options override raw options",
+			opts: []broker.Option{
+				ConnectWait(6 * time.Second),
+				Options(stan.Options{ConnectTimeout: 4 * time.Second, MaxPubAcksInflight: 10}),
+			},
+			connectWait: 6 * time.Second,
+			ackWait:     defaults.AckTimeout,
+			inflight:    10,
+		},
+		{
+			name:        "addresses override the raw nats url",
+			opts:        []broker.Option{Options(stan.Options{NatsURL: "nats://127.0.0.1:1"})},
+			connectWait: defaults.ConnectTimeout,
+			ackWait:     defaults.AckTimeout,
+			inflight:    defaults.MaxPubAcksInflight,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBroker(t, addr, tc.opts...)
+			defer b.Disconnect()
+
+			opts := b.EffectiveStanOptions()
+			if opts.ConnectTimeout != tc.connectWait {
+				t.Errorf("Expected connect wait %v, got %v", tc.connectWait, opts.ConnectTimeout)
+			}
+			if opts.AckTimeout != tc.ackWait {
+				t.Errorf("Expected ack wait %v, got %v", tc.ackWait, opts.AckTimeout)
+			}
+			if opts.MaxPubAcksInflight != tc.inflight {
+				t.Errorf("Expected %d publish acks in flight, got %d", tc.inflight, opts.MaxPubAcksInflight)
+			}
+			if opts.NatsURL != "nats://"+addr {
+				t.Errorf("Expected nats url %s, got %s", "nats://"+addr, opts.NatsURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package stan
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// reorderIdle is how long the catch-up may be idle before buffered messages are delivered
+const reorderIdle = 200 * time.Millisecond
+
+// reorderer buffers publications during a redelivery catch-up window and
+// delivers them in sequence order once the window goes idle
+type reorderer struct {
+	sync.Mutex
+	deliver func(*publication)
+	buf     []*publication
+	timer   *time.Timer
+}
+
+func newReorderer(deliver func(*publication)) *reorderer {
+	return &reorderer{deliver: deliver}
+}
+
+// handle passes publications through until a redelivery starts a catch-up window
+func (r *reorderer) handle(p *publication) {
+	r.Lock()
+	if len(r.buf) == 0 && !p.msg.Redelivered {
+		r.Unlock()
+		r.deliver(p)
+		return
+	}
+
+	r.buf = append(r.buf, p)
+	if r.timer == nil {
+		r.timer = time.AfterFunc(reorderIdle, r.flush)
+	} else {
+		r.timer.Reset(reorderIdle)
+	}
+	r.Unlock()
+}
+
+// flush delivers the buffered publications in sequence order
+func (r *reorderer) flush() {
+	r.Lock()
+	defer r.Unlock()
+
+	sort.SliceStable(r.buf, func(i, j int) bool {
+		return r.buf[i].msg.Sequence < r.buf[j].msg.Sequence
+	})
+	for _, p := range r.buf {
+		r.deliver(p)
+	}
+	r.buf = nil
+}
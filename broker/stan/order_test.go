@@ -0,0 +1,84 @@
+package stan
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+)
+
+func TestReorderer(t *testing.T) {
+	delivered := make(chan uint64, 10)
+	r := newReorderer(func(p *publication) {
+		delivered <- p.msg.Sequence
+	})
+
+	pub := func(seq uint64, redelivered bool) *publication {
+		return &publication{msg: &stan.Msg{MsgProto: pb.MsgProto{Sequence: seq, Redelivered: redelivered}}}
+	}
+
+	// live messages are passed straight through
+	r.handle(pub(1, false))
+	r.handle(pub(2, false))
+
+	// redelivered in-flight messages interleaved with new ones after a reconnect
+	r.handle(pub(4, true))
+	r.handle(pub(6, false))
+	r.handle(pub(3, true))
+	r.handle(pub(5, false))
+
+	var got []uint64
+	for i := 0; i < 6; i++ {
+		select {
+		case seq := <-delivered:
+			got = append(got, seq)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timeout waiting for delivery, got %v", got)
+		}
+	}
+	if fmt.Sprint(got) != "[1 2 3 4 5 6]" {
+		t.Errorf("Expected in order delivery, got %v", got)
+	}
+}
+
+func TestOrderedRedeliveryAcksAfterDelivery(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan string, 4)
+	sub, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, OrderedRedelivery(true), SubscribeOptions().AckWait(time.Second).Build())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// buffered messages must not be acked by stan when the callback returns
+	var opts stan.SubscriptionOptions
+	for _, o := range sub.(*subscriber).sopts {
+		o(&opts)
+	}
+	if !opts.ManualAcks {
+		t.Error("Expected OrderedRedelivery to subscribe in manual ack mode")
+	}
+
+	if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, ch); body != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", body)
+	}
+	// acked once handled, so it isn't redelivered
+	select {
+	case body := <-ch:
+		t.Errorf("Expected no redelivery, got %q", body)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
@@ -0,0 +1,94 @@
+package stan
+
+import "sync"
+
+// gate blocks deliveries while paused
+type gate struct {
+	sync.Mutex
+	ch chan struct{}
+}
+
+// wait blocks while the gate is paused or until quit is closed
+func (g *gate) wait(quit <-chan struct{}) {
+	g.Lock()
+	ch := g.ch
+	g.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case <-ch:
+	case <-quit:
+	}
+}
+
+func (g *gate) pause() {
+	g.Lock()
+	if g.ch == nil {
+		g.ch = make(chan struct{})
+	}
+	g.Unlock()
+}
+
+func (g *gate) resume() {
+	g.Lock()
+	if g.ch != nil {
+		close(g.ch)
+		g.ch = nil
+	}
+	g.Unlock()
+}
+
+// Pause stops delivering messages to the handler without unsubscribing. Messages
+// are buffered by the client up to the subscription's pending limits, and are
+// redelivered by the server if the pause exceeds the subscription's AckWait.
+func (n *subscriber) Pause() {
+	n.gate.pause()
+}
+
+// Resume continues delivering messages to the handler after Pause
+func (n *subscriber) Resume() {
+	n.gate.resume()
+}
+
+// busy counts the callbacks and worker deliveries in progress
+type busy struct {
+	sync.Mutex
+	n    int
+	idle chan struct{}
+}
+
+func (b *busy) add() {
+	b.Lock()
+	if b.n == 0 {
+		b.idle = make(chan struct{})
+	}
+	b.n++
+	b.Unlock()
+}
+
+func (b *busy) done() {
+	b.Lock()
+	b.n--
+	if b.n == 0 {
+		close(b.idle)
+	}
+	b.Unlock()
+}
+
+// wait returns a channel closed once nothing is in progress
+func (b *busy) wait() <-chan struct{} {
+	b.Lock()
+	defer b.Unlock()
+	if b.n == 0 {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	return b.idle
+}
+
+// idle returns a channel closed once no callback or worker delivery is in-flight
+func (n *subscriber) idle() <-chan struct{} {
+	return n.inflight.wait()
+}
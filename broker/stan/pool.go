@@ -0,0 +1,101 @@
+package stan
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	nats "github.com/nats-io/nats.go"
+	stan "github.com/nats-io/stan.go"
+)
+
+// publishPool spreads publishes round robin over additional connections
+type publishPool struct {
+	conns []stan.Conn
+	ncs   []*nats.Conn
+	next  uint32
+}
+
+func (p *publishPool) pick() stan.Conn {
+	i := atomic.AddUint32(&p.next, 1)
+	return p.conns[i%uint32(len(p.conns))]
+}
+
+func (p *publishPool) close() {
+	for _, c := range p.conns {
+		c.Close()
+	}
+	for _, nc := range p.ncs {
+		nc.Close()
+	}
+}
+
+// dialPool connects one stan connection per target, each connection prefers its
+// target address and fails over to the other addresses in order
+func dialPool(clusterID, clientID string, targets, addrs []string, natsOpts []nats.Option, opts []stan.Option) (*publishPool, error) {
+	p := &publishPool{}
+	for i, target := range targets {
+		urls := []string{target}
+		for _, addr := range addrs {
+			if addr != target {
+				urls = append(urls, addr)
+			}
+		}
+
+		id := fmt.Sprintf("%s-pub-%d", clientID, i)
+		nopts := append(append([]nats.Option(nil), natsOpts...), nats.Name(id), nats.DontRandomize())
+		nc, err := nats.Connect(strings.Join(urls, ","), nopts...)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.ncs = append(p.ncs, nc)
+
+		c, err := stan.Connect(clusterID, id, append(append([]stan.Option(nil), opts...), stan.NatsConn(nc))...)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.conns = append(p.conns, c)
+	}
+	return p, nil
+}
+
+// weightedTargets assigns an address to each of n connections in proportion to the
+// weights, using smooth weighted round robin. Addresses without a weight count 1,
+// addresses with a weight below 1 get no connection unless all of them do.
+func weightedTargets(addrs []string, weights map[string]int, n int) []string {
+	w := make([]int, len(addrs))
+	var total int
+	for i, addr := range addrs {
+		w[i] = 1
+		if v, ok := weights[addr]; ok {
+			w[i] = v
+		}
+		if w[i] < 0 {
+			w[i] = 0
+		}
+		total += w[i]
+	}
+	if total == 0 {
+		for i := range w {
+			w[i] = 1
+		}
+		total = len(w)
+	}
+
+	targets := make([]string, 0, n)
+	current := make([]int, len(addrs))
+	for len(targets) < n {
+		best := 0
+		for i := range current {
+			current[i] += w[i]
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		targets = append(targets, addrs[best])
+	}
+	return targets
+}
@@ -0,0 +1,65 @@
+package stan
+
+import (
+	"testing"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestWeightedTargets(t *testing.T) {
+	addrs := []string{"nats://local:4222", "nats://remote:4222", "nats://other:4222"}
+	targets := weightedTargets(addrs, map[string]int{"nats://local:4222": 3, "nats://other:4222": 0}, 8)
+
+	counts := make(map[string]int)
+	for _, target := range targets {
+		counts[target]++
+	}
+	if counts["nats://local:4222"] != 6 || counts["nats://remote:4222"] != 2 || counts["nats://other:4222"] != 0 {
+		t.Errorf("Expected connections spread 6:2:0 by weight, got %v", counts)
+	}
+
+	// all weights zero spreads evenly
+	targets = weightedTargets(addrs[:2], map[string]int{"nats://local:4222": 0, "nats://remote:4222": 0}, 4)
+	if targets[0] == targets[1] || targets[0] != targets[2] {
+		t.Errorf("Expected an even spread, got %v", targets)
+	}
+}
+
+func TestPublishConns(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, PublishConns(3), AddressWeights(map[string]int{addr: 2}))
+	defer b.Disconnect()
+
+	if b.pool == nil || len(b.pool.conns) != 3 {
+		t.Fatalf("Expected a pool of 3 connections, got %v", b.pool)
+	}
+	for _, c := range b.pool.conns {
+		if url := c.NatsConn().ConnectedUrl(); url != "nats://"+addr {
+			t.Errorf("Expected pooled connection to %s, got %s", addr, url)
+		}
+	}
+
+	ch := make(chan string, 3)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, ch)
+	}
+
+	pool := b.pool
+	if err := b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if b.pool != nil || !pool.ncs[0].IsClosed() {
+		t.Error("Expected Disconnect to close the pool")
+	}
+}
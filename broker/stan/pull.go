@@ -0,0 +1,175 @@
+package stan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/micro/go-micro/v2/broker"
+	stan "github.com/nats-io/stan.go"
+)
+
+// ResultStatus is the processing result reported by AckWithResult
+type ResultStatus string
+
+const (
+	// ResultSuccess reports a processed message
+	ResultSuccess ResultStatus = "success"
+	// ResultFailure reports a message that failed processing
+	ResultFailure ResultStatus = "failure"
+)
+
+// ResultRecord is published as JSON to the ResultSubject by AckWithResult
+type ResultRecord struct {
+	Topic    string       `json:"topic"`
+	Sequence uint64       `json:"sequence"`
+	Status   ResultStatus `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+}
+
+// PullSubscriber hands messages out on Fetch instead of passing them to a handler.
+// Messages are acked by the caller, messages that aren't fetched or acked within the
+// AckWait are redelivered.
+type PullSubscriber struct {
+	broker.Subscriber
+	b       *stanBroker
+	results string
+	// up to MaxInflight messages waiting for a Fetch
+	msgs chan broker.Event
+	done chan struct{}
+	// closed when the subscription is released, e.g. by Disconnect
+	quit chan struct{}
+	once sync.Once
+}
+
+// PullSubscribe subscribes to topic in manual ack mode for fetching messages with
+// Fetch. Handler options like Workers or RetryHandler don't apply.
+func (n *stanBroker) PullSubscribe(topic string, opts ...broker.SubscribeOption) (*PullSubscriber, error) {
+	opt := broker.SubscribeOptions{Context: context.Background()}
+	for _, o := range opts {
+		o(&opt)
+	}
+	ctx := opt.Context
+	if subscribeContext, ok := ctx.Value(subscribeContextKey{}).(context.Context); ok && subscribeContext != nil {
+		ctx = subscribeContext
+	}
+
+	// the server has at most MaxInflight unacked messages out, buffering as many
+	// lets a Fetch return a batch
+	bopts := stan.DefaultSubscriptionOptions
+	if subOpts, ok := ctx.Value(subscribeOptionKey{}).([]stan.SubscriptionOption); ok {
+		for _, bopt := range subOpts {
+			if err := bopt(&bopts); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	p := &PullSubscriber{
+		b:    n,
+		msgs: make(chan broker.Event, bopts.MaxInflight),
+		done: make(chan struct{}),
+	}
+	p.results, _ = ctx.Value(resultSubjectKey{}).(string)
+
+	opts = append(append([]broker.SubscribeOption(nil), opts...), broker.DisableAutoAck())
+	sub, err := n.Subscribe(topic, func(e broker.Event) error {
+		var quit chan struct{}
+		if pub, ok := e.(*publication); ok && pub.sub != nil {
+			quit = pub.sub.quit
+		}
+		// the message waits for a Fetch
+		select {
+		case p.msgs <- e:
+		case <-p.done:
+		case <-quit:
+		}
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	p.Subscriber = sub
+	if s, ok := sub.(*subscriber); ok {
+		p.quit = s.quit
+	}
+	return p, nil
+}
+
+var errPullClosed = errors.New("[stan]: pull subscription closed")
+
+// Fetch returns up to max messages, it waits for the first one until ctx is done
+func (p *PullSubscriber) Fetch(ctx context.Context, max int) ([]broker.Event, error) {
+	if max < 1 {
+		return nil, errors.New("[stan]: fetch of less than one message")
+	}
+
+	var events []broker.Event
+	select {
+	case e := <-p.msgs:
+		events = append(events, e)
+	case <-p.done:
+		return nil, errPullClosed
+	case <-p.quit:
+		return nil, errPullClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	for len(events) < max {
+		select {
+		case e := <-p.msgs:
+			events = append(events, e)
+		default:
+			return events, nil
+		}
+	}
+	return events, nil
+}
+
+// AckWithResult acks a fetched message and publishes a ResultRecord with status and
+// detail to the ResultSubject if one is set
+func (p *PullSubscriber) AckWithResult(e broker.Event, status ResultStatus, detail string) error {
+	if err := e.Ack(); err != nil {
+		return err
+	}
+	if len(p.results) == 0 {
+		return nil
+	}
+
+	rec := ResultRecord{Topic: e.Topic(), Status: status, Detail: detail}
+	if pub, ok := e.(*publication); ok && pub.msg != nil {
+		rec.Sequence = pub.msg.Sequence
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return p.b.Publish(p.results, &broker.Message{
+		Header: map[string]string{"Content-Type": "application/json"},
+		Body:   b,
+	})
+}
+
+// Unsubscribe releases messages waiting for a Fetch and removes the subscription,
+// unacked messages are redelivered
+func (p *PullSubscriber) Unsubscribe() error {
+	p.stop()
+	return p.Subscriber.Unsubscribe()
+}
+
+// Close releases messages waiting for a Fetch and closes the subscription, a
+// durable keeps its interest on the server
+func (p *PullSubscriber) Close() error {
+	p.stop()
+	if c, ok := p.Subscriber.(interface{ Close() error }); ok {
+		return c.Close()
+	}
+	return p.Subscriber.Unsubscribe()
+}
+
+func (p *PullSubscriber) stop() {
+	p.once.Do(func() {
+		close(p.done)
+	})
+}
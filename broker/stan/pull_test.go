@@ -0,0 +1,134 @@
+package stan
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestPullAckWithResult(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	records := make(chan ResultRecord, 1)
+	if _, err := b.Subscribe("jobs.results", func(e broker.Event) error {
+		var rec ResultRecord
+		if err := json.Unmarshal(e.Message().Body, &rec); err != nil {
+			t.Error(err)
+		}
+		records <- rec
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := b.PullSubscribe("jobs", ResultSubject("jobs.results"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	if err := b.Publish("jobs", &broker.Message{Body: []byte("job")}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, err := sub.Fetch(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || string(events[0].Message().Body) != "job" {
+		t.Fatalf("Expected the published job, got %d events", len(events))
+	}
+	if err := sub.AckWithResult(events[0], ResultFailure, "bad input"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case rec := <-records:
+		if rec.Topic != "jobs" || rec.Sequence != 1 || rec.Status != ResultFailure || rec.Detail != "bad input" {
+			t.Errorf("Unexpected result record %+v", rec)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a result record")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := sub.Fetch(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("Expected the acked job not to be fetched again, got %v", err)
+	}
+}
+
+func TestPullFetchBatch(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	for i := 0; i < 5; i++ {
+		if err := b.Publish("jobs", &broker.Message{Body: []byte("job")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub, err := b.PullSubscribe("jobs", SubscribeOptions().DeliverAllAvailable().Build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	// the messages are buffered until fetched
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sub.msgs) < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, err := sub.Fetch(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 5 {
+		t.Errorf("Expected a batch of 5 messages, got %d", len(events))
+	}
+}
+
+func TestPullClose(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	closed, err := b.PullSubscribe("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := closed.Fetch(context.Background(), 1); err != errPullClosed {
+		t.Errorf("Expected %v after Close, got %v", errPullClosed, err)
+	}
+
+	disconnected, err := b.PullSubscribe("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := disconnected.Fetch(context.Background(), 1); err != errPullClosed {
+		t.Errorf("Expected %v after Disconnect, got %v", errPullClosed, err)
+	}
+}
@@ -0,0 +1,72 @@
+package stan
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+// ErrRateLimited is returned by Publish when the rate limit is exceeded and
+// FailOnRateLimit is set
+var ErrRateLimited = errors.New("[stan]: publish rate limited")
+
+// limiter is a token bucket refilled at rate tokens per second up to burst
+type limiter struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rps, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:   float64(rps),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take removes a token and returns how long to wait before it is available.
+// Without reserve a token that isn't available yet is left in the bucket.
+func (l *limiter) take(reserve bool) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if reserve {
+		l.tokens--
+	}
+	return wait
+}
+
+// wrap blocks publishes until a token is available, or fails them with
+// ErrRateLimited if fail is set
+func (l *limiter) wrap(fail bool, fn PublishFunc) PublishFunc {
+	return func(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+		if wait := l.take(!fail); wait > 0 {
+			if fail {
+				return ErrRateLimited
+			}
+			time.Sleep(wait)
+		}
+		return fn(topic, msg, opts...)
+	}
+}
@@ -0,0 +1,43 @@
+package stan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestLimiter(t *testing.T) {
+	var calls int
+	fn := func(string, *broker.Message, ...broker.PublishOption) error {
+		calls++
+		return nil
+	}
+
+	// the burst is immediate, the rest at 20 per second
+	publish := newLimiter(20, 2).wrap(false, fn)
+	start := time.Now()
+	for i := 0; i < 12; i++ {
+		if err := publish("test", &broker.Message{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 450*time.Millisecond {
+		t.Errorf("Expected the rate to be capped, 12 publishes took %v", d)
+	}
+	if calls != 12 {
+		t.Errorf("Expected 12 publishes, got %d", calls)
+	}
+
+	publish = newLimiter(1, 1).wrap(true, fn)
+	if err := publish("test", &broker.Message{}); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if err := publish("test", &broker.Message{}); err != ErrRateLimited {
+		t.Fatalf("Expected ErrRateLimited, got %v", err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("Expected a limited publish to fail promptly, took %v", d)
+	}
+}
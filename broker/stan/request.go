@@ -0,0 +1,93 @@
+package stan
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/micro/go-micro/v2/broker"
+)
+
+// ReplyHeader is the message header carrying the reply subject of a request
+const ReplyHeader = "Micro-Reply-To"
+
+// Request publishes msg to topic with a generated reply subject in the ReplyHeader
+// and waits for the first message published to it, or until the context is done.
+// Responders publish their reply to the subject found in the header. Every request
+// creates a channel on the server, so channel inactivity limits should be configured.
+func (n *stanBroker) Request(ctx context.Context, topic string, msg *broker.Message) (*broker.Message, error) {
+	reply := "_INBOX." + uuid.New().String()
+
+	ch := make(chan *broker.Message, 1)
+	sub, err := n.Subscribe(reply, func(e broker.Event) error {
+		select {
+		case ch <- e.Message():
+		default:
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	header := make(map[string]string, len(msg.Header)+1)
+	for k, v := range msg.Header {
+		header[k] = v
+	}
+	header[ReplyHeader] = reply
+
+	if err := n.Publish(topic, &broker.Message{Header: header, Body: msg.Body}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case rsp := <-ch:
+		return rsp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ConfirmHeader is the message header carrying the id a consumer confirms
+const ConfirmHeader = "Micro-Confirm-Id"
+
+// PublishAndConfirm publishes msg to topic with a generated id in the ConfirmHeader
+// and waits until a consumer confirms it, or until the context is done. It requires
+// cooperating consumers: they confirm by publishing a message carrying the same
+// ConfirmHeader to ackSubject once the message was processed.
+func (n *stanBroker) PublishAndConfirm(ctx context.Context, topic string, msg *broker.Message, ackSubject string) error {
+	id := uuid.New().String()
+
+	ch := make(chan struct{}, 1)
+	sub, err := n.Subscribe(ackSubject, func(e broker.Event) error {
+		if e.Message().Header[ConfirmHeader] != id {
+			return nil
+		}
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	header := make(map[string]string, len(msg.Header)+1)
+	for k, v := range msg.Header {
+		header[k] = v
+	}
+	header[ConfirmHeader] = id
+
+	if err := n.Publish(topic, &broker.Message{Header: header, Body: msg.Body}); err != nil {
+		return err
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
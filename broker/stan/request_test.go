@@ -0,0 +1,85 @@
+package stan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestRequest(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	// echo responder
+	if _, err := b.Subscribe("echo", func(e broker.Event) error {
+		reply := e.Message().Header[ReplyHeader]
+		return b.Publish(reply, &broker.Message{Body: e.Message().Body})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rsp, err := b.Request(ctx, "echo", &broker.Message{Body: []byte("ping")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp.Body) != "ping" {
+		t.Errorf("Expected %q, got %q", "ping", rsp.Body)
+	}
+
+	// nobody responds on this topic
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := b.Request(ctx, "void", &broker.Message{Body: []byte("ping")}); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+
+	// only the responder subscription remains
+	if l := len(b.Subscriptions()); l != 1 {
+		t.Errorf("Expected reply subscriptions to be cleaned up, got %d subscriptions", l)
+	}
+}
+
+func TestPublishAndConfirm(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	// confirming consumer
+	if _, err := b.Subscribe("orders", func(e broker.Event) error {
+		// an unrelated confirmation is ignored
+		if err := b.Publish("orders.ack", &broker.Message{Header: map[string]string{ConfirmHeader: "other"}}); err != nil {
+			return err
+		}
+		id := e.Message().Header[ConfirmHeader]
+		return b.Publish("orders.ack", &broker.Message{Header: map[string]string{ConfirmHeader: id}})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// consumer that never confirms
+	if _, err := b.Subscribe("events", func(e broker.Event) error {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.PublishAndConfirm(ctx, "orders", &broker.Message{Body: []byte("order")}, "orders.ack"); err != nil {
+		t.Errorf("Expected the message to be confirmed, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := b.PublishAndConfirm(ctx, "events", &broker.Message{Body: []byte("event")}, "events.ack"); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package stan
+
+import (
+	"errors"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+// shardedSubscriber subscribes a single handler to every shard of a topic
+type shardedSubscriber struct {
+	t    string
+	opts broker.SubscribeOptions
+	subs []broker.Subscriber
+}
+
+func (s *shardedSubscriber) Options() broker.SubscribeOptions {
+	return s.opts
+}
+
+func (s *shardedSubscriber) Topic() string {
+	return s.t
+}
+
+// Unsubscribe removes the subscriptions of all shards
+func (s *shardedSubscriber) Unsubscribe() error {
+	var err error
+	for _, sub := range s.subs {
+		if uerr := sub.Unsubscribe(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+	return err
+}
+
+// shards returns the number of shards configured with Shards
+func (n *stanBroker) shards() (int, error) {
+	shards, _ := n.opts.Context.Value(shardsKey{}).(int)
+	if shards < 1 {
+		return 0, errors.New("[stan]: no shards configured")
+	}
+	return shards, nil
+}
+
+// shardSubject returns the subject of shard i of topic
+func shardSubject(topic string, i int) string {
+	return topic + "." + strconv.Itoa(i)
+}
+
+// shardOf maps key to one of shards, the same key always maps to the same shard
+func shardOf(key string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// ShardedPublish publishes msg to one of the Shards subjects topic.0 to topic.N-1,
+// chosen by the key returned by keyFunc. Messages with the same key land on the
+// same shard and keep their order.
+func (n *stanBroker) ShardedPublish(topic string, msg *broker.Message, keyFunc func(*broker.Message) string, opts ...broker.PublishOption) error {
+	shards, err := n.shards()
+	if err != nil {
+		return err
+	}
+	return n.Publish(shardSubject(topic, shardOf(keyFunc(msg), shards)), msg, opts...)
+}
+
+// ShardedSubscribe subscribes handler to every shard of topic. Each shard is a
+// separate subscription, so the shards are handled in parallel.
+func (n *stanBroker) ShardedSubscribe(topic string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	shards, err := n.shards()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &shardedSubscriber{t: topic}
+	for i := 0; i < shards; i++ {
+		sub, err := n.Subscribe(shardSubject(topic, i), handler, opts...)
+		if err != nil {
+			s.Unsubscribe()
+			return nil, err
+		}
+		s.opts = sub.Options()
+		s.subs = append(s.subs, sub)
+	}
+	return s, nil
+}
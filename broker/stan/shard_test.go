@@ -0,0 +1,83 @@
+package stan
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestShardedPublish(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, Shards(4))
+	defer b.Disconnect()
+
+	var mu sync.Mutex
+	shards := make(map[string]map[string]bool)
+	done := make(chan struct{}, 30)
+	sub, err := b.ShardedSubscribe("orders", func(e broker.Event) error {
+		mu.Lock()
+		key := e.Message().Header["Key"]
+		if shards[key] == nil {
+			shards[key] = make(map[string]bool)
+		}
+		shards[key][e.Topic()] = true
+		mu.Unlock()
+		done <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	keyFunc := func(m *broker.Message) string {
+		return m.Header["Key"]
+	}
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	for i := 0; i < 5; i++ {
+		for _, key := range keys {
+			msg := &broker.Message{Header: map[string]string{"Key": key}, Body: []byte("order")}
+			if err := b.ShardedPublish("orders", msg, keyFunc); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for i := 0; i < 5*len(keys); i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for message %d", i)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, key := range keys {
+		if len(shards[key]) != 1 {
+			t.Errorf("Expected key %s on a single shard, got %v", key, shards[key])
+		}
+		for topic := range shards[key] {
+			if want := shardSubject("orders", shardOf(key, 4)); topic != want {
+				t.Errorf("Expected key %s on %s, got %s", key, want, topic)
+			}
+		}
+	}
+}
+
+func TestShardedPublishWithoutShards(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	err := b.ShardedPublish("orders", &broker.Message{}, func(*broker.Message) string { return "" })
+	if err == nil {
+		t.Error("Expected ShardedPublish to fail without Shards")
+	}
+}
@@ -0,0 +1,31 @@
+package stan
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// ErrInvalidSignature is reported to the error handler for messages failing verification
+var ErrInvalidSignature = errors.New("[stan]: invalid signature")
+
+// sign appends the HMAC-SHA256 of data
+func sign(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(data[:len(data):len(data)])
+}
+
+// verify checks and strips the HMAC appended by sign
+func verify(key, data []byte) ([]byte, error) {
+	if len(data) < sha256.Size {
+		return nil, ErrInvalidSignature
+	}
+	payload, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return nil, ErrInvalidSignature
+	}
+	return payload, nil
+}
@@ -0,0 +1,129 @@
+package stan
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+	stan "github.com/nats-io/stan.go"
+)
+
+func TestSign(t *testing.T) {
+	key := []byte("secret")
+	data := []byte("hello world")
+
+	signed := sign(key, data)
+	payload, err := verify(key, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, data) {
+		t.Errorf("Expected %q, got %q", data, payload)
+	}
+
+	tampered := append([]byte(nil), signed...)
+	tampered[0] ^= 0xff
+	if _, err := verify(key, tampered); err != ErrInvalidSignature {
+		t.Errorf("Expected ErrInvalidSignature for a flipped byte, got %v", err)
+	}
+	if _, err := verify([]byte("other"), signed); err != ErrInvalidSignature {
+		t.Errorf("Expected ErrInvalidSignature for another key, got %v", err)
+	}
+	if _, err := verify(key, []byte("short")); err != ErrInvalidSignature {
+		t.Errorf("Expected ErrInvalidSignature for a short payload, got %v", err)
+	}
+}
+
+func TestSignBroker(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	key := []byte("secret")
+	errs := make(chan error, 4)
+	b := newTestBroker(t, addr, Sign(key), broker.ErrorHandler(func(e broker.Event) error {
+		errs <- e.Error()
+		return nil
+	}))
+	defer b.Disconnect()
+
+	ch := make(chan string, 2)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, AckOnSuccess(), SubscribeOption(stan.AckWait(time.Second))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, ch); body != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", body)
+	}
+
+	// flip a byte of a signed payload
+	data, err := b.opts.Codec.Marshal(&broker.Message{Body: []byte("tampered")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = sign(key, data)
+	data[len(data)/2] ^= 0xff
+	if err := b.conn.Publish("test", data); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != ErrInvalidSignature {
+			t.Errorf("Expected ErrInvalidSignature, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the error handler")
+	}
+	select {
+	case body := <-ch:
+		t.Errorf("Expected the tampered message not to reach the handler, got %q", body)
+	case err := <-errs:
+		t.Errorf("Expected the tampered message to be acked, got redelivered with %v", err)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+func TestSignEmptyPayload(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	errs := make(chan error, 1)
+	b := newTestBroker(t, addr, Sign([]byte("secret")), broker.ErrorHandler(func(e broker.Event) error {
+		errs <- e.Error()
+		return nil
+	}))
+	defer b.Disconnect()
+
+	ch := make(chan string, 1)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, AllowEmptyPayloads(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unsigned empty payload
+	if err := b.conn.Publish("test", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != ErrInvalidSignature {
+			t.Errorf("Expected ErrInvalidSignature, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the empty payload to fail verification")
+	}
+	select {
+	case body := <-ch:
+		t.Errorf("Expected the unsigned message not to be handled, got %q", body)
+	default:
+	}
+}
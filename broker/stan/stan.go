@@ -2,19 +2,26 @@
 package stan
 
 import (
+	"bytes"
 	"context"
+	"crypto/cipher"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/micro/go-micro/v2/broker"
+	"github.com/micro/go-micro/v2/codec"
 	"github.com/micro/go-micro/v2/codec/json"
 	"github.com/micro/go-micro/v2/cmd"
 	log "github.com/micro/go-micro/v2/logger"
+	nats "github.com/nats-io/nats.go"
 	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
 )
 
 type stanBroker struct {
@@ -24,28 +31,96 @@ type stanBroker struct {
 	opts           broker.Options
 	sopts          stan.Options
 	nopts          []stan.Option
+	natsOpts       []nats.Option
+	nc             *nats.Conn
+	pool           *publishPool
+	poolTargets    []string
 	clusterID      string
 	clientID       string
 	connectTimeout time.Duration
+	maxConnect     time.Duration
 	connectRetry   bool
+	reconnecting   int32
+	closing        int32
+	// connects and reconnects in progress, they read the options without the lock
+	connecting int
+	// the sentinels of CreateChannelsOnConnect were published since the Connect
+	channelsCreated bool
 	done           chan struct{}
 	ctx            context.Context
+	aead           cipher.AEAD
+	compress       bool
+	compressMin    int
+	compactHeaders bool
+	credentials    string
+	signKey        []byte
+	circuit        *circuit
+	limiter        *limiter
+	coalescer      *coalescer
+	dedup          *deduplicator
+	failLimited    bool
+	// dials the connections, connectStan unless replaced in tests
+	connectFn connectFunc
+	// serializes readiness transitions, ready is read atomically
+	readyMu sync.Mutex
+	ready   int32
+	grace   *time.Timer
+	subs    map[*subscriber]struct{}
+	stats   *stats
+	states  stateListeners
+
+	// channels seen with a subscriber by WaitForSubscribers
+	subscribed sync.Map
 }
 
 type subscriber struct {
-	t    string
-	s    stan.Subscription
-	dq   bool
-	opts broker.SubscribeOptions
+	// messages passed to the handler, the sequence of the latest one and the highest
+	// received sequence, first for the alignment of atomic access
+	delivered uint64
+	last      uint64
+	received  uint64
+
+	mu      sync.RWMutex
+	t       string
+	s       stan.Subscription
+	dq      bool
+	durable string
+	opts    broker.SubscribeOptions
+	sopts   []stan.SubscriptionOption
+	fn      stan.MsgHandler
+	eh      broker.Handler
+	b       *stanBroker
+	quit    chan struct{}
+	once    sync.Once
+	gate    *gate
+	batch   *ackBatcher
+	offsets *offsets
+	// messages of a non-durable left unacked, its resume position after a reconnect
+	unacked *offsets
+	events  bool
+	// in-flight callbacks and worker deliveries
+	inflight busy
 }
 
 type publication struct {
-	t   string
-	msg *stan.Msg
-	m   *broker.Message
-	err error
+	t       string
+	msg     *stan.Msg
+	m       *broker.Message
+	err     error
+	ctx     context.Context
+	sub     *subscriber
+	batch   *ackBatcher
+	offsets *offsets
 }
 
+// ErrStaleAck is returned when acking a message received before a reconnect, the
+// server redelivers it on the new connection
+var ErrStaleAck = errors.New("[stan]: message received before a reconnect")
+
+// ErrMessageTooLarge is reported to the error handler for a received message larger
+// than the MaxReceiveSize
+var ErrMessageTooLarge = errors.New("[stan]: received message exceeds the maximum size")
+
 func init() {
 	cmd.DefaultBrokers["stan"] = NewBroker
 }
@@ -59,6 +134,19 @@ func (n *publication) Message() *broker.Message {
 }
 
 func (n *publication) Ack() error {
+	if n.sub != nil && n.msg.Sub != n.sub.sub() {
+		return ErrStaleAck
+	}
+	if n.offsets != nil {
+		n.offsets.acked(n.msg)
+	}
+	if n.sub != nil && n.sub.unacked != nil {
+		n.sub.unacked.acked(n.msg)
+	}
+	if n.batch != nil {
+		n.batch.add(n.msg)
+		return nil
+	}
 	return n.msg.Ack()
 }
 
@@ -75,29 +163,191 @@ func (n *subscriber) Topic() string {
 }
 
 func (n *subscriber) Unsubscribe() error {
-	if n.s == nil {
+	s := n.sub()
+	if s == nil {
 		return nil
 	}
 	// go-micro server Unsubscribe can't handle durable queues, so close as stan suggested
 	// from nats streaming readme:
 	// When a client disconnects, the streaming server is not notified, hence the importance of calling Close()
-	if !n.dq {
-		err := n.s.Unsubscribe()
-		if err != nil {
-			return err
-		}
+	if n.dq {
+		return n.Close()
 	}
-	return n.Close()
+	defer n.release()
+	n.stopAcks()
+	n.logEvent(eventUnsubscribe, 0)
+	return s.Unsubscribe()
 }
 
 func (n *subscriber) Close() error {
-	if n.s != nil {
-		return n.s.Close()
+	defer n.release()
+	n.stopAcks()
+	n.logEvent(eventClose, 0)
+	if s := n.sub(); s != nil {
+		return s.Close()
+	}
+	return nil
+}
+
+// stopAcks sends the acks batched by AckBatch while the subscription is still open
+func (n *subscriber) stopAcks() {
+	if n.batch != nil {
+		n.batch.stop()
+	}
+}
+
+// sub returns the current stan subscription
+func (n *subscriber) sub() stan.Subscription {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.s
+}
+
+// subscribe creates a stan subscription with the subscriber's callback and options,
+// extra options are applied last
+func (n *subscriber) subscribe(conn stan.Conn, extra ...stan.SubscriptionOption) (stan.Subscription, error) {
+	opts := append(append([]stan.SubscriptionOption(nil), n.sopts...), extra...)
+	if len(n.opts.Queue) > 0 {
+		return conn.QueueSubscribe(n.t, n.opts.Queue, n.fn, opts...)
+	}
+	return conn.Subscribe(n.t, n.fn, opts...)
+}
+
+// update closes the stan subscription and resumes it with extra options appended,
+// they are kept for later resubscriptions. If the new subscription fails the old
+// options are resumed.
+func (n *subscriber) update(conn stan.Conn, extra []stan.SubscriptionOption) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// batched acks must be sent before the messages belong to a closed subscription
+	if n.batch != nil {
+		n.batch.flush()
+	}
+	if err := n.s.Close(); err != nil {
+		return err
+	}
+	if n.offsets != nil {
+		n.offsets.reset()
+	}
+
+	prev := n.sopts
+	n.sopts = append(append([]stan.SubscriptionOption(nil), prev...), extra...)
+	sub, err := n.subscribe(conn)
+	if err != nil {
+		n.sopts = prev
+		if sub, rerr := n.subscribe(conn); rerr == nil {
+			n.s = sub
+		}
+		return err
+	}
+	n.s = sub
+	return nil
+}
+
+// promote replaces the subscription by a durable starting after the last received
+// message, the durable options are kept for later resubscriptions
+func (n *subscriber) promote(conn stan.Conn, durableName string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.dq {
+		return errors.New("[stan]: subscription is already durable")
+	}
+
+	start := stan.StartAt(pb.StartPosition_NewOnly)
+	if last := atomic.LoadUint64(&n.received); last > 0 {
+		start = stan.StartAtSequence(last + 1)
+	}
+	prev := n.sopts
+	n.sopts = append(append([]stan.SubscriptionOption(nil), prev...), stan.DurableName(durableName), start)
+	sub, err := n.subscribe(conn)
+	if err != nil {
+		n.sopts = prev
+		return err
+	}
+
+	if n.batch != nil {
+		n.batch.flush()
+	}
+	if err := n.s.Unsubscribe(); err != nil {
+		n.b.logf(log.WarnLevel, "[stan]: failed to remove subscription of %s: %v", n.t, err)
+	}
+	n.s = sub
+	n.durable = durableName
+	n.dq = true
+	return nil
+}
+
+// resubscribe replaces the subscription of a lost connection, pending acks and
+// offsets belong to the lost subscription and are dropped. A durable resumes at its
+// position on the server, other subscriptions at their lowest unacked sequence or
+// after the highest received one instead of their start position.
+func (n *subscriber) resubscribe(conn stan.Conn) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var dropped []*stan.Msg
+	if n.batch != nil {
+		dropped = n.batch.discard()
+	}
+	if n.offsets != nil {
+		n.offsets.reset()
 	}
+	var extra []stan.SubscriptionOption
+	if seq, ok := n.resume(dropped); ok && !n.dq {
+		extra = append(extra, stan.StartAtSequence(seq))
+	}
+	if n.unacked != nil {
+		n.unacked.reset()
+	}
+	sub, err := n.subscribe(conn, extra...)
+	if err != nil {
+		return err
+	}
+	n.s = sub
 	return nil
 }
 
+// resume returns the sequence a non-durable continues at on a new connection, the
+// lowest message not acked on the lost one, including acks dropped from the batch,
+// or the one after the highest received sequence
+func (n *subscriber) resume(dropped []*stan.Msg) (uint64, bool) {
+	seq := atomic.LoadUint64(&n.received)
+	if seq == 0 {
+		return 0, false
+	}
+	seq++
+	if n.unacked != nil {
+		if low, ok := n.unacked.lowest(); ok && low < seq {
+			seq = low
+		}
+	}
+	for _, msg := range dropped {
+		if msg.Sequence < seq {
+			seq = msg.Sequence
+		}
+	}
+	return seq, true
+}
+
+// release removes the subscriber from the broker's active subscriptions and stops its
+// workers, it's called after closing the stan subscription so callbacks it unblocks
+// can no longer ack their message
+func (n *subscriber) release() {
+	n.once.Do(func() {
+		if n.quit != nil {
+			close(n.quit)
+		}
+		if n.b != nil {
+			n.b.Lock()
+			delete(n.b.subs, n)
+			n.b.Unlock()
+		}
+	})
+}
+
 func (n *stanBroker) Address() string {
+	n.RLock()
+	defer n.RUnlock()
 	// stan does not support connected server info
 	if len(n.addrs) > 0 {
 		return n.addrs[0]
@@ -106,6 +356,21 @@ func (n *stanBroker) Address() string {
 	return ""
 }
 
+// ClusterID returns the cluster id the broker connects to, empty before Connect
+func (n *stanBroker) ClusterID() string {
+	n.RLock()
+	defer n.RUnlock()
+	return n.clusterID
+}
+
+// ClientID returns the client id of the connection, generated unless configured,
+// empty before Connect
+func (n *stanBroker) ClientID() string {
+	n.RLock()
+	defer n.RUnlock()
+	return n.clientID
+}
+
 func setAddrs(addrs []string) []string {
 	cAddrs := make([]string, 0, len(addrs))
 	for _, addr := range addrs {
@@ -123,43 +388,352 @@ func setAddrs(addrs []string) []string {
 	return cAddrs
 }
 
-func (n *stanBroker) reconnectCB(c stan.Conn, err error) {
+// logf logs to the Logger option, or the default logger, if level is enabled by LogLevel
+func (n *stanBroker) logf(level log.Level, format string, v ...interface{}) {
+	if !n.logEnabled(level) {
+		return
+	}
+	n.logger().Logf(level, format, v...)
+}
+
+// logEnabled reports whether level is enabled by the LogLevel option
+func (n *stanBroker) logEnabled(level log.Level) bool {
+	min, ok := n.opts.Context.Value(logLevelKey{}).(log.Level)
+	return !ok || min.Enabled(level)
+}
+
+// logger returns the Logger option or the default logger
+func (n *stanBroker) logger() log.Logger {
+	if l, ok := n.opts.Context.Value(loggerKey{}).(log.Logger); ok && l != nil {
+		return l
+	}
+	return log.DefaultLogger
+}
+
+// setReady records the connection state and reports transitions to the Readiness callback
+func (n *stanBroker) setReady(ready bool) {
+	n.readyMu.Lock()
+	defer n.readyMu.Unlock()
+	n.setReadyLocked(ready)
+}
+
+func (n *stanBroker) setReadyLocked(ready bool) {
+	// any transition ends a pending grace period
+	if n.grace != nil {
+		n.grace.Stop()
+		n.grace = nil
+	}
+	var v int32
+	if ready {
+		v = 1
+	}
+	if atomic.SwapInt32(&n.ready, v) == v {
+		return
+	}
+	if fn, ok := n.opts.Context.Value(readinessKey{}).(func(bool)); ok && fn != nil {
+		fn(ready)
+	}
+}
+
+// markLost reports the broker not ready once the ReconnectGrace elapsed without
+// a reconnect, or immediately without a grace period
+func (n *stanBroker) markLost() {
+	grace, _ := n.opts.Context.Value(reconnectGraceKey{}).(time.Duration)
+	n.readyMu.Lock()
+	defer n.readyMu.Unlock()
+	if grace <= 0 {
+		n.setReadyLocked(false)
+		return
+	}
+	if n.grace != nil {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(grace, func() {
+		n.readyMu.Lock()
+		defer n.readyMu.Unlock()
+		if n.grace == t {
+			n.setReadyLocked(false)
+		}
+	})
+	n.grace = t
+}
+
+// Ready reports whether the broker holds a working connection
+func (n *stanBroker) Ready() bool {
+	return atomic.LoadInt32(&n.ready) == 1
+}
+
+// notifyLost passes a lost connection to the OnConnectionLost callback
+func (n *stanBroker) notifyLost(err error, intentional bool) {
+	if fn, ok := n.opts.Context.Value(connectionLostKey{}).(func(error, bool)); ok && fn != nil {
+		fn(err, intentional)
+	}
+}
+
+// connectionLost marks the broker lost and reconnects if ConnectRetry is set,
+// otherwise the custom ConnectionLostCB is called
+func (n *stanBroker) connectionLost(c stan.Conn, err error) {
+	defer n.startConnect()()
+	n.markLost()
+	// Disconnect reports deliberate closes itself
+	if atomic.LoadInt32(&n.closing) == 1 {
+		return
+	}
+	n.states.emit(Disconnected)
+	// unanswered pings are told apart from closed connections
+	if errors.Is(err, stan.ErrMaxPings) {
+		if fn, ok := n.opts.Context.Value(pingFailureKey{}).(func(error)); ok && fn != nil {
+			fn(err)
+		}
+	}
+	n.notifyLost(err, false)
 	if n.connectRetry {
-		if err := n.connect(); err != nil {
-			log.Error(err)
+		n.reconnectCB(c, err)
+		return
+	}
+	if n.sopts.ConnectionLostCB != nil {
+		n.sopts.ConnectionLostCB(c, err)
+	}
+}
+
+func (n *stanBroker) reconnectCB(c stan.Conn, err error) {
+	if !n.connectRetry {
+		return
+	}
+	// coalesce callbacks fired while a reconnect is already in progress,
+	// the running connect loop will establish the connection for all of them
+	if !atomic.CompareAndSwapInt32(&n.reconnecting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&n.reconnecting, 0)
+	n.states.emit(Reconnecting)
+
+	// connect logs giving up
+	if err := n.connect(context.WithValue(context.Background(), reconnectKey{}, true)); err != nil {
+		n.states.emit(Disconnected)
+		return
+	}
+	n.resubscribe()
+	n.states.reconnect()
+}
+
+// startConnect counts a connect in progress until the returned func is called, Init
+// refuses to replace the options meanwhile
+func (n *stanBroker) startConnect() func() {
+	n.Lock()
+	n.connecting++
+	n.Unlock()
+	return func() {
+		n.Lock()
+		n.connecting--
+		n.Unlock()
+	}
+}
+
+// channelSentinel is the payload of the sentinels of CreateChannelsOnConnect, the
+// leading zero byte keeps it apart from encoded messages
+var channelSentinel = []byte("\x00stan:create-channel")
+
+// isChannelSentinel reports whether data is a sentinel of CreateChannelsOnConnect
+func isChannelSentinel(data []byte) bool {
+	return bytes.Equal(data, channelSentinel)
+}
+
+// reconnectKey marks the connect of a reconnect, a failing PostConnect hook is
+// retried instead of leaving the broker disconnected
+type reconnectKey struct{}
+
+// resubscribe recreates the tracked subscriptions on the connection established by
+// a reconnect. Durables resume where the server left them, so their unacked messages
+// are redelivered, other subscriptions resume at their lowest unacked sequence or
+// after the highest received one.
+// Messages received on the lost connection can no longer be acked, see ErrStaleAck.
+func (n *stanBroker) resubscribe() {
+	n.RLock()
+	conn := n.conn
+	subs := make([]*subscriber, 0, len(n.subs))
+	for s := range n.subs {
+		subs = append(subs, s)
+	}
+	n.RUnlock()
+	if conn == nil {
+		return
+	}
+
+	for _, s := range subs {
+		if err := s.resubscribe(conn); err != nil {
+			n.logf(log.ErrorLevel, "[stan]: failed to resubscribe to %s: %v", s.t, err)
+		}
+	}
+}
+
+// connectContext looks values up in the connect context first, then in the options
+type connectContext struct {
+	context.Context
+	opts context.Context
+}
+
+func (c *connectContext) Value(key interface{}) interface{} {
+	if v := c.Context.Value(key); v != nil {
+		return v
+	}
+	return c.opts.Value(key)
+}
+
+// connectFunc dials the streaming connection of a connect attempt. With natsOpts it
+// dials the nats connection to url first and returns it, to be closed by the caller.
+type connectFunc func(url, clusterID, clientID string, natsOpts []nats.Option, opts []stan.Option) (stan.Conn, *nats.Conn, error)
+
+// connectStan is the connectFunc of the broker
+func connectStan(url, clusterID, clientID string, natsOpts []nats.Option, opts []stan.Option) (stan.Conn, *nats.Conn, error) {
+	var nc *nats.Conn
+	// the broker owns the nats connection unless a custom one was given
+	if natsOpts != nil {
+		var err error
+		if nc, err = nats.Connect(url, natsOpts...); err != nil {
+			return nil, nil, err
+		}
+		opts = append(append([]stan.Option(nil), opts...), stan.NatsConn(nc))
+	}
+	c, err := stan.Connect(clusterID, clientID, opts...)
+	if err != nil {
+		if nc != nil {
+			nc.Close()
 		}
+		return nil, nil, err
 	}
+	return c, nc, nil
 }
 
-func (n *stanBroker) connect() error {
+func (n *stanBroker) connect(ctx context.Context) error {
 	timeout := make(<-chan time.Time)
+	ceiling := make(<-chan time.Time)
+	var deadline time.Time
 
 	n.RLock()
 	if n.connectTimeout > 0 {
 		timeout = time.After(n.connectTimeout)
 	}
+	maxConnect := n.maxConnect
+	if maxConnect > 0 {
+		deadline = time.Now().Add(maxConnect)
+		ceiling = time.After(maxConnect)
+	}
+	connectWait := n.sopts.ConnectTimeout
 	clusterID := n.clusterID
 	clientID := n.clientID
 	nopts := n.nopts
+	natsOpts := n.natsOpts
+	if natsOpts != nil && len(n.credentials) > 0 {
+		natsOpts = append(append([]nats.Option(nil), natsOpts...), nats.UserCredentials(n.credentials))
+	}
+	url := strings.Join(n.addrs, ",")
+	addrs := n.addrs
+	targets := n.poolTargets
+	connectFn := n.connectFn
 	n.RUnlock()
 
+	// pooled publish connections don't trigger a reconnect of the broker
+	poolOpts := append(append([]stan.Option(nil), nopts...), stan.SetConnectionLostHandler(func(_ stan.Conn, err error) {
+		n.logf(log.WarnLevel, "[stan]: publish connection lost: %v", err)
+	}))
+
+	// options given to ConnectCtx take precedence over the broker options
+	values := &connectContext{Context: ctx, opts: n.opts.Context}
+	// a failing PostConnect hook aborts connecting, a reconnect retries it
+	hook, _ := values.Value(postConnectKey{}).(func(stan.Conn) error)
+	var hookErr error
+	reconnect, _ := ctx.Value(reconnectKey{}).(bool)
+	channels, _ := values.Value(createChannelsKey{}).([]string)
+
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
 	fn := func() error {
-		c, err := stan.Connect(clusterID, clientID, nopts...)
-		if err == nil {
-			n.Lock()
-			n.conn = c
-			n.Unlock()
+		hookErr = nil
+		opts := nopts
+		dialOpts := natsOpts
+		// attempts are shortened to the time left before the ceiling
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return fmt.Errorf("[stan]: connect exceeded %v", maxConnect)
+			}
+			if connectWait <= 0 || left < connectWait {
+				opts = append(append([]stan.Option(nil), opts...), stan.ConnectWait(left))
+			}
+			if natsOpts != nil {
+				dialOpts = append(append([]nats.Option(nil), natsOpts...), nats.Timeout(left))
+			}
 		}
-		return err
+		c, nc, err := connectFn(url, clusterID, clientID, dialOpts, opts)
+		if err != nil {
+			return err
+		}
+		if hook != nil {
+			if hookErr = hook(c); hookErr != nil {
+				c.Close()
+				err = hookErr
+			}
+		}
+		var pool *publishPool
+		if err == nil && len(targets) > 0 {
+			if pool, err = dialPool(clusterID, clientID, targets, addrs, natsOpts, poolOpts); err != nil {
+				c.Close()
+			}
+		}
+		if err != nil {
+			if nc != nil {
+				nc.Close()
+			}
+			return err
+		}
+		// a sentinel creates the channel, subscribers skip it. Reconnects find the
+		// channels created already.
+		n.RLock()
+		created := n.channelsCreated
+		n.RUnlock()
+		if !created {
+			for _, channel := range channels {
+				if err := c.Publish(subjectName(values, channel), channelSentinel); err != nil {
+					n.logf(log.WarnLevel, "[stan]: failed to create channel %s: %v", channel, err)
+				}
+			}
+		}
+		n.Lock()
+		prev, prevPool := n.nc, n.pool
+		n.conn = c
+		n.nc = nc
+		n.pool = pool
+		n.channelsCreated = true
+		n.Unlock()
+		// the connections of a lost stan connection are replaced
+		if prev != nil {
+			prev.Close()
+		}
+		if prevPool != nil {
+			prevPool.close()
+		}
+		n.setReady(true)
+		n.states.emit(Connected)
+		return nil
 	}
 
 	// don't wait for first try
-	if err := fn(); err == nil {
+	lastErr := fn()
+	if lastErr == nil {
 		return nil
 	}
+	if hookErr != nil {
+		n.logf(log.ErrorLevel, "[stan]: post connect hook failed: %v", hookErr)
+		if !reconnect {
+			return hookErr
+		}
+	} else if isPermanentConnectError(lastErr) {
+		n.logf(log.ErrorLevel, "[stan]: failed to connect %v: %v", n.addrs, lastErr)
+		return &ConnectError{Err: lastErr}
+	}
 
 	n.RLock()
 	done := n.done
@@ -171,27 +745,61 @@ func (n *stanBroker) connect() error {
 		// context closed
 		case <-n.opts.Context.Done():
 			return nil
+		// connect aborted
+		case <-ctx.Done():
+			return ctx.Err()
 		// call close, don't wait anymore
 		case <-done:
 			return nil
 		//  in case of timeout fail with a timeout error
 		case <-timeout:
+			n.logf(log.ErrorLevel, "[stan]: failed to connect %v: %v", n.addrs, lastErr)
 			return fmt.Errorf("[stan]: timeout connect to %v", n.addrs)
+		// a hard ceiling regardless of the attempts in progress
+		case <-ceiling:
+			n.logf(log.ErrorLevel, "[stan]: failed to connect %v within %v: %v", n.addrs, maxConnect, lastErr)
+			return fmt.Errorf("[stan]: connect to %v exceeded %v", n.addrs, maxConnect)
 		// got a tick, try to connect
 		case <-ticker.C:
-			err := fn()
-			if err == nil {
-				log.Infof("[stan]: successeful connected to %v", n.addrs)
+			lastErr = fn()
+			if lastErr == nil {
+				n.logf(log.InfoLevel, "[stan]: successeful connected to %v", n.addrs)
 				return nil
 			}
-			log.Errorf("[stan]: failed to connect %v: %v\n", n.addrs, err)
+			if hookErr != nil {
+				n.logf(log.ErrorLevel, "[stan]: post connect hook failed: %v", hookErr)
+				if !reconnect {
+					return hookErr
+				}
+				continue
+			}
+			if isPermanentConnectError(lastErr) {
+				n.logf(log.ErrorLevel, "[stan]: failed to connect %v: %v", n.addrs, lastErr)
+				return &ConnectError{Err: lastErr}
+			}
+			// single attempts are expected to fail during an outage
+			n.logf(log.DebugLevel, "[stan]: failed to connect %v: %v", n.addrs, lastErr)
 		}
 	}
-
-	return nil
 }
 
 func (n *stanBroker) Connect() error {
+	return n.ConnectCtx(context.Background())
+}
+
+// ConnectCtx connects like Connect, values of ctx and the given options take precedence
+// over the broker options and cancelling ctx aborts the connect loop. Options returns
+// the broker options unchanged, but the connection settings derived from the connect
+// options, e.g. the cluster and client id, timeouts or encryption, stay in effect for
+// reconnects until the next Connect or ConnectCtx.
+func (n *stanBroker) ConnectCtx(ctx context.Context, opts ...broker.Option) error {
+	defer n.startConnect()()
+	o := broker.Options{Context: ctx}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	ctx = &connectContext{Context: o.Context, opts: n.opts.Context}
+
 	n.RLock()
 	if n.conn != nil {
 		n.RUnlock()
@@ -199,30 +807,91 @@ func (n *stanBroker) Connect() error {
 	}
 	n.RUnlock()
 
-	clusterID, ok := n.opts.Context.Value(clusterIDKey{}).(string)
+	clusterID, ok := ctx.Value(clusterIDKey{}).(string)
 	if !ok || len(clusterID) == 0 {
 		return errors.New("must specify ClusterID Option")
 	}
 
-	clientID, ok := n.opts.Context.Value(clientIDKey{}).(string)
+	clientID, ok := ctx.Value(clientIDKey{}).(string)
 	if !ok || len(clientID) == 0 {
 		clientID = uuid.New().String()
 	}
 
 	n.Lock()
-	if v, ok := n.opts.Context.Value(connectRetryKey{}).(bool); ok && v {
+	atomic.StoreInt32(&n.closing, 0)
+	// recreate the done channel closed by a previous Disconnect
+	if n.done == nil {
+		n.done = make(chan struct{})
+	}
+
+	if v, ok := ctx.Value(connectRetryKey{}).(bool); ok && v {
 		n.connectRetry = true
 	}
 
-	if td, ok := n.opts.Context.Value(connectTimeoutKey{}).(time.Duration); ok {
+	if td, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok {
 		n.connectTimeout = td
 	}
 
+	if td, ok := ctx.Value(maxConnectDurationKey{}).(time.Duration); ok {
+		n.maxConnect = td
+	}
+
+	// defaults < raw stan options < typed options, the raw options may have been
+	// changed by Init or the connect options
+	raw, _ := ctx.Value(optionsKey{}).(stan.Options)
+	n.sopts = mergeStanOptions(raw)
+	if td, ok := ctx.Value(connectWaitKey{}).(time.Duration); ok && td > 0 {
+		n.sopts.ConnectTimeout = td
+	}
+
 	if n.sopts.ConnectionLostCB != nil && n.connectRetry {
 		n.Unlock()
 		return errors.New("impossible to use custom ConnectionLostCB and ConnectRetry(true)")
 	}
 
+	if enc, ok := ctx.Value(encryptionKey{}).(encryption); ok {
+		aead, err := newAEAD(enc.key, enc.algo)
+		if err != nil {
+			n.Unlock()
+			return err
+		}
+		n.aead = aead
+	}
+
+	if key, ok := ctx.Value(signKey{}).([]byte); ok && len(key) > 0 {
+		n.signKey = key
+	}
+
+	if threshold, ok := ctx.Value(compressThresholdKey{}).(int); ok {
+		n.compress = true
+		n.compressMin = threshold
+	}
+
+	if v, ok := ctx.Value(compactHeadersKey{}).(bool); ok {
+		n.compactHeaders = v
+	}
+
+	// the circuit state survives reconnects
+	if cb, ok := ctx.Value(circuitBreakerKey{}).(circuitBreaker); ok && cb.failures > 0 && n.circuit == nil {
+		n.circuit = newCircuit(cb.failures, cb.reset)
+	}
+
+	// so does the token bucket
+	if rl, ok := ctx.Value(publishRateLimitKey{}).(rateLimit); ok && rl.rps > 0 && n.limiter == nil {
+		n.limiter = newLimiter(rl.rps, rl.burst)
+	}
+	if v, ok := ctx.Value(failOnRateLimitKey{}).(bool); ok {
+		n.failLimited = v
+	}
+
+	if td, ok := ctx.Value(coalescePublishKey{}).(time.Duration); ok && td > 0 && n.coalescer == nil {
+		n.coalescer = newCoalescer(td, n.logf)
+	}
+
+	if dd, ok := ctx.Value(deduplicatePublishKey{}).(deduplicate); ok && dd.window > 0 && dd.size > 0 && n.dedup == nil {
+		n.dedup = newDeduplicator(dd.window, dd.size)
+	}
+
 	nopts := []stan.Option{
 		stan.NatsURL(n.sopts.NatsURL),
 		stan.NatsConn(n.sopts.NatsConn),
@@ -232,59 +901,462 @@ func (n *stanBroker) Connect() error {
 		stan.Pings(n.sopts.PingInterval, n.sopts.PingMaxOut),
 	}
 
-	if n.connectRetry {
-		nopts = append(nopts, stan.SetConnectionLostHandler(n.reconnectCB))
-	}
+	nopts = append(nopts, stan.SetConnectionLostHandler(n.connectionLost))
 
 	nopts = append(nopts, stan.NatsURL(strings.Join(n.addrs, ",")))
 
+	// same defaults stan applies to the connections it creates
+	n.natsOpts = nil
+	if n.sopts.NatsConn == nil {
+		n.natsOpts = []nats.Option{
+			nats.Name(clientID),
+			nats.MaxReconnects(-1),
+			nats.ReconnectBufSize(-1),
+		}
+		if v, ok := ctx.Value(natsNoRandomizeKey{}).(bool); ok && v {
+			n.natsOpts = append(n.natsOpts, nats.DontRandomize())
+		}
+		if dial, ok := ctx.Value(proxyDialerKey{}).(func(network, addr string) (net.Conn, error)); ok && dial != nil {
+			n.natsOpts = append(n.natsOpts, nats.SetCustomDialer(dialerFunc(dial)))
+		}
+		if td, ok := ctx.Value(flushTimeoutKey{}).(time.Duration); ok && td > 0 {
+			n.natsOpts = append(n.natsOpts, nats.FlusherTimeout(td))
+		}
+		if td, ok := ctx.Value(natsPingIntervalKey{}).(time.Duration); ok && td > 0 {
+			n.natsOpts = append(n.natsOpts, nats.PingInterval(td))
+		}
+		// last so they override the options above
+		if opts, ok := ctx.Value(natsOptionsKey{}).([]nats.Option); ok {
+			n.natsOpts = append(n.natsOpts, opts...)
+		}
+	}
+
+	n.poolTargets = nil
+	if size, ok := ctx.Value(publishConnsKey{}).(int); ok && size > 0 {
+		if n.natsOpts == nil {
+			n.Unlock()
+			return errors.New("impossible to use PublishConns with a custom NatsConn")
+		}
+		weights := make(map[string]int)
+		if w, ok := ctx.Value(addressWeightsKey{}).(map[string]int); ok {
+			for addr, weight := range w {
+				weights[setAddrs([]string{addr})[0]] = weight
+			}
+		}
+		n.poolTargets = weightedTargets(n.addrs, weights, size)
+	}
+
 	n.nopts = nopts
 	n.clusterID = clusterID
 	n.clientID = clientID
 	n.Unlock()
 
-	return n.connect()
+	return n.connect(ctx)
+}
+
+// EffectiveStanOptions returns a copy of the stan options resolved by the last Connect
+// from the broker options and the stan defaults. NatsConn is the connection owned
+// by the broker if it dialed one.
+func (n *stanBroker) EffectiveStanOptions() stan.Options {
+	n.RLock()
+	defer n.RUnlock()
+
+	opts := stan.GetDefaultOptions()
+	for _, o := range n.nopts {
+		o(&opts)
+	}
+	if n.nc != nil {
+		opts.NatsConn = n.nc
+	}
+	return opts
 }
 
 func (n *stanBroker) Disconnect() error {
 	var err error
+	var closed bool
 
-	n.Lock()
-	defer n.Unlock()
+	// coalesced messages are sent while still connected
+	n.RLock()
+	c := n.coalescer
+	n.RUnlock()
+	if c != nil {
+		c.flush()
+	}
 
+	atomic.StoreInt32(&n.closing, 1)
+	n.Lock()
 	if n.done != nil {
 		close(n.done)
 		n.done = nil
 	}
+	n.channelsCreated = false
+	// subscriptions closed with the connection aren't resumed by a later connect
+	subs := make([]*subscriber, 0, len(n.subs))
+	for s := range n.subs {
+		subs = append(subs, s)
+	}
+	// batched acks are sent while the subscriptions are still open
+	for _, s := range subs {
+		s.stopAcks()
+	}
 	if n.conn != nil {
 		err = n.conn.Close()
+		n.conn = nil
+		closed = true
 	}
-	return err
-}
+	if n.pool != nil {
+		n.pool.close()
+		n.pool = nil
+	}
+	if n.nc != nil {
+		n.nc.Close()
+		n.nc = nil
+	}
+	n.Unlock()
 
-func (n *stanBroker) Init(opts ...broker.Option) error {
-	for _, o := range opts {
-		o(&n.opts)
+	for _, s := range subs {
+		s.release()
 	}
-	n.addrs = setAddrs(n.opts.Addrs)
-	return nil
+	n.setReady(false)
+	if closed {
+		n.states.emit(Disconnected)
+		n.notifyLost(err, true)
+	}
+	n.states.close()
+	return err
 }
 
-func (n *stanBroker) Options() broker.Options {
-	return n.opts
-}
+// Shutdown gracefully stops the broker. It unsubscribes all tracked subscribers,
+// durable subscriptions are closed so their interest is kept on the server, flushes
+// pending publishes and disconnects. The context bounds unsubscribing and flushing,
+// the broker is disconnected even if the context expires. Messages buffered but not
+// yet handled, e.g. waiting for a worker, are not acked so they are redelivered.
+func (n *stanBroker) Shutdown(ctx context.Context) error {
+	var err error
 
-func (n *stanBroker) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
-	b, err := n.opts.Codec.Marshal(msg)
-	if err != nil {
-		return err
+	for _, s := range n.Subscriptions() {
+		if ctx.Err() != nil {
+			break
+		}
+		if uerr := s.Unsubscribe(); uerr != nil && err == nil {
+			err = uerr
+		}
 	}
+
+	n.RLock()
+	conn := n.conn
+	n.RUnlock()
+
+	if conn != nil && ctx.Err() == nil {
+		if nc := conn.NatsConn(); nc != nil {
+			var ferr error
+			if _, ok := ctx.Deadline(); ok {
+				ferr = nc.FlushWithContext(ctx)
+			} else {
+				ferr = nc.Flush()
+			}
+			if ferr != nil && err == nil {
+				err = ferr
+			}
+		}
+	}
+
+	if derr := n.Disconnect(); derr != nil && err == nil {
+		err = derr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// Init applies options before Connect. The options are read without locking while
+// connected, so Init fails once connected, Disconnect to change them.
+func (n *stanBroker) Init(opts ...broker.Option) error {
+	n.Lock()
+	defer n.Unlock()
+	if n.conn != nil {
+		return errors.New("[stan]: Init while connected, Disconnect first")
+	}
+	if n.connecting > 0 {
+		return errors.New("[stan]: Init while connecting, wait for the connect to return")
+	}
+	for _, o := range opts {
+		o(&n.opts)
+	}
+	n.addrs = setAddrs(n.opts.Addrs)
+	return nil
+}
+
+func (n *stanBroker) Options() broker.Options {
 	n.RLock()
 	defer n.RUnlock()
-	return n.conn.Publish(topic, b)
+	return n.opts
+}
+
+func (n *stanBroker) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	// a snapshot, Init may replace the options of a broker that isn't connected
+	brokerOpts := n.Options()
+	if len(topic) == 0 {
+		topic, _ = brokerOpts.Context.Value(defaultTopicKey{}).(string)
+		if len(topic) == 0 {
+			return errors.New("[stan]: no topic and no DefaultTopic set")
+		}
+	}
+
+	var options broker.PublishOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	if options.Context != nil {
+		if key, ok := options.Context.Value(headerSubjectKey{}).(string); ok {
+			token := msg.Header[key]
+			if !validToken(token) {
+				return fmt.Errorf("[stan]: header %s value %q is not a valid subject token", key, token)
+			}
+			topic = topic + "." + token
+		}
+	}
+	topic = subjectName(brokerOpts.Context, topic)
+
+	if timeout, ok := brokerOpts.Context.Value(waitForSubscribersKey{}).(time.Duration); ok && timeout > 0 {
+		n.waitForSubscribers(topic, timeout)
+	}
+
+	fn := n.publish
+	n.RLock()
+	if n.circuit != nil {
+		fn = n.circuit.wrap(fn)
+	}
+	if n.limiter != nil {
+		fn = n.limiter.wrap(n.failLimited, fn)
+	}
+	if n.coalescer != nil {
+		fn = n.coalescer.wrap(fn)
+	}
+	if n.dedup != nil {
+		fn = n.dedup.wrap(fn)
+	}
+	n.RUnlock()
+	// apply middleware in reverse so the first one is the outermost
+	if mws, ok := brokerOpts.Context.Value(publishMiddlewareKey{}).([]PublishWrapper); ok {
+		for i := len(mws); i > 0; i-- {
+			fn = mws[i-1](fn)
+		}
+	}
+	if tracer, ok := brokerOpts.Context.Value(tracerKey{}).(Tracer); ok && tracer != nil {
+		fn = tracePublish(tracer)(fn)
+	}
+	return fn(topic, msg, opts...)
+}
+
+func (n *stanBroker) publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	b, err := n.marshal(msg)
+	if err != nil {
+		return err
+	}
+	n.RLock()
+	defer n.RUnlock()
+	if n.conn == nil {
+		return errors.New("not connected")
+	}
+	if n.compress {
+		if b, err = compress(b, n.compressMin); err != nil {
+			return err
+		}
+	}
+	if n.aead != nil {
+		if b, err = encrypt(n.aead, b); err != nil {
+			return err
+		}
+	}
+	if n.signKey != nil {
+		b = sign(n.signKey, b)
+	}
+	conn := n.conn
+	if n.pool != nil {
+		conn = n.pool.pick()
+	}
+
+	var options broker.PublishOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	if options.Context != nil {
+		// fire and forget, a missing ack is only logged
+		if level, ok := options.Context.Value(reliabilityKey{}).(ReliabilityLevel); ok && level == PublishAtMostOnce {
+			_, err := conn.PublishAsync(topic, b, func(_ string, err error) {
+				if err != nil {
+					n.logf(log.WarnLevel, "[stan]: at most once publish to %s failed: %v", topic, err)
+				}
+			})
+			return err
+		}
+	}
+	return conn.Publish(topic, b)
+}
+
+// marshal encodes msg with the codec, or with compact headers if enabled
+func (n *stanBroker) marshal(msg *broker.Message) ([]byte, error) {
+	n.RLock()
+	compact := n.compactHeaders
+	n.RUnlock()
+	if compact {
+		return marshalCompact(msg), nil
+	}
+	return n.codec().Marshal(msg)
+}
+
+// codec returns the configured codec, falling back to json if an option cleared it
+func (n *stanBroker) codec() codec.Marshaler {
+	n.RLock()
+	defer n.RUnlock()
+	if n.opts.Codec == nil {
+		return json.Marshaler{}
+	}
+	return n.opts.Codec
+}
+
+// decodeFunc decodes the payload of a message received on subject
+type decodeFunc func(subject string, data []byte) (*broker.Message, error)
+
+// decode returns the publication for a received message, on error the
+// publication carries the error and the raw payload as body. The payload is
+// unmarshaled with fn if set, else with the codec.
+func (n *stanBroker) decode(msg *stan.Msg, fn decodeFunc) (*publication, error) {
+	var m broker.Message
+	p := &publication{m: &m, msg: msg, t: msg.Subject}
+
+	data := msg.Data
+	n.RLock()
+	aead := n.aead
+	compressed := n.compress
+	compact := n.compactHeaders
+	key := n.signKey
+	n.RUnlock()
+	// an empty payload is an empty message, with signing it fails to verify
+	if len(data) == 0 && key == nil {
+		return p, nil
+	}
+	if key != nil {
+		var err error
+		if data, err = verify(key, data); err != nil {
+			p.err = err
+			p.m.Body = msg.Data
+			return p, err
+		}
+	}
+	if aead != nil {
+		var err error
+		if data, err = decrypt(aead, data); err != nil {
+			p.err = err
+			p.m.Body = msg.Data
+			return p, err
+		}
+	}
+	if compressed {
+		var err error
+		if data, err = decompress(data); err != nil {
+			p.err = err
+			p.m.Body = msg.Data
+			return p, err
+		}
+	}
+
+	if fn != nil {
+		dm, err := fn(msg.Subject, data)
+		if err == nil && dm == nil {
+			err = errors.New("[stan]: decode func returned no message")
+		}
+		if err != nil {
+			p.err = err
+			p.m.Body = data
+			return p, err
+		}
+		p.m = dm
+		return p, nil
+	}
+
+	// payloads without the flag byte are codec envelopes of other publishers
+	if compact && len(data) > 0 && data[0] == payloadCompactHeaders {
+		cm, err := unmarshalCompact(data)
+		if err != nil {
+			p.err = err
+			p.m.Body = data
+			return p, err
+		}
+		p.m = cm
+		return p, nil
+	}
+
+	// unmarshal message
+	if err := n.codec().Unmarshal(data, &m); err != nil {
+		p.err = err
+		p.m.Body = data
+		return p, err
+	}
+	return p, nil
+}
+
+// dialerFunc adapts a dial function to a nats.CustomDialer
+type dialerFunc func(network, addr string) (net.Conn, error)
+
+func (d dialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return d(network, addr)
+}
+
+// validToken reports whether s can be used as a single subject token
+func validToken(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	return !strings.ContainsAny(s, ".*> \t\r\n")
+}
+
+// matchHeaders reports whether header contains all key/values of match
+func matchHeaders(header, match map[string]string) bool {
+	for k, v := range match {
+		if hv, ok := header[k]; !ok || hv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// warnLimited logs a warning if the channel has limits, replaying it from the start
+// may miss discarded messages. It's a no-op without the monitoring endpoint.
+func (n *stanBroker) warnLimited(topic string) {
+	if _, ok := n.opts.Context.Value(monitoringURLKey{}).(string); !ok {
+		return
+	}
+	maxMsgs, maxBytes, maxAge, err := n.ChannelLimits(topic)
+	if err != nil {
+		n.logf(log.WarnLevel, "[stan]: failed to get limits of channel %s: %v", topic, err)
+		return
+	}
+	if maxMsgs > 0 || maxBytes > 0 || maxAge > 0 {
+		n.logf(log.WarnLevel, "[stan]: replaying limited channel %s (max msgs %d, max bytes %d, max age %v), discarded messages are missed",
+			topic, maxMsgs, maxBytes, maxAge)
+	}
+}
+
+// handleError passes a failed publication to the error handler, or logs it if none is set
+func (n *subscriber) handleError(p *publication) {
+	if p.msg != nil {
+		n.logEvent(eventError, p.msg.Sequence)
+	}
+	if n.eh != nil {
+		n.eh(p)
+		return
+	}
+	n.b.logf(log.ErrorLevel, "[stan]: failed to process message on %s: %v", p.t, p.err)
 }
 
 func (n *stanBroker) Subscribe(topic string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	// a snapshot, Init may replace the options of a broker that isn't connected
+	brokerOpts := n.Options()
+	topic = subjectName(brokerOpts.Context, topic)
+
 	n.RLock()
 	if n.conn == nil {
 		n.RUnlock()
@@ -298,6 +1370,11 @@ func (n *stanBroker) Subscribe(topic string, handler broker.Handler, opts ...bro
 		AutoAck: true,
 	}
 
+	// broker level defaults are applied first so per call options override them
+	if defaults, ok := brokerOpts.Context.Value(defaultSubscribeOptionsKey{}).([]broker.SubscribeOption); ok {
+		opts = append(append([]broker.SubscribeOption(nil), defaults...), opts...)
+	}
+
 	for _, o := range opts {
 		o(&opt)
 	}
@@ -312,6 +1389,24 @@ func (n *stanBroker) Subscribe(topic string, handler broker.Handler, opts ...bro
 		ctx = subscribeContext
 	}
 
+	raw, _ := ctx.Value(rawHandlerKey{}).(func(*stan.Msg) error)
+
+	// the first message tells whether producers use the same codec
+	var codecChecked int32
+	codecCheck, _ := ctx.Value(codecCheckKey{}).(bool)
+	mismatch, _ := ctx.Value(codecMismatchKey{}).(func(topic string, err error))
+	if codecCheck && mismatch == nil {
+		mismatch = func(topic string, err error) {
+			n.logf(log.WarnLevel, "[stan]: first message of %s failed to decode with the %s codec, likely a codec mismatch: %v", topic, n.codec(), err)
+		}
+	}
+	if handler == nil && raw == nil {
+		return nil, ErrNilHandler
+	}
+
+	store, _ := ctx.Value(checkpointKey{}).(CheckpointStore)
+	timeout, _ := ctx.Value(handlerTimeoutKey{}).(time.Duration)
+
 	var stanOpts []stan.SubscriptionOption
 	if !opt.AutoAck {
 		stanOpts = append(stanOpts, stan.SetManualAckMode())
@@ -321,11 +1416,31 @@ func (n *stanBroker) Subscribe(topic string, handler broker.Handler, opts ...bro
 		stanOpts = append(stanOpts, subOpts...)
 	}
 
+	var window *backlog
+	if d, ok := ctx.Value(backlogWindowKey{}).(time.Duration); ok && d > 0 {
+		stanOpts = append(stanOpts, stan.StartAtTimeDelta(d))
+		window = newBacklog(d, time.Now())
+	}
+	maxAge, _ := ctx.Value(maxMessageAgeKey{}).(time.Duration)
+	allowEmpty, _ := ctx.Value(allowEmptyPayloadsKey{}).(bool)
+	maxSize, _ := ctx.Value(maxReceiveSizeKey{}).(int)
+
 	if bval, ok := ctx.Value(ackSuccessKey{}).(bool); ok && bval {
 		stanOpts = append(stanOpts, stan.SetManualAckMode())
 		ackSuccess = true
 	}
 
+	// resume after the last checkpoint, overriding the start position
+	if store != nil {
+		seq, err := store.Load(topic)
+		if err != nil {
+			return nil, err
+		}
+		if seq > 0 {
+			stanOpts = append(stanOpts, stan.StartAtSequence(seq+1))
+		}
+	}
+
 	bopts := stan.DefaultSubscriptionOptions
 	for _, bopt := range stanOpts {
 		if err := bopt(&bopts); err != nil {
@@ -335,43 +1450,695 @@ func (n *stanBroker) Subscribe(topic string, handler broker.Handler, opts ...bro
 
 	opt.AutoAck = !bopts.ManualAcks
 
-	if dn, ok := n.opts.Context.Value(durableKey{}).(string); ok && len(dn) > 0 {
+	if store != nil && raw == nil {
+		// failures are redelivered unless acked regardless of the handler result
+		once, _ := ctx.Value(atMostOnceKey{}).(bool)
+		handler = n.checkpointHandler(store, bopts.ManualAcks && !once, handler)
+	}
+
+	if timeout > 0 && raw == nil {
+		handler = timeoutHandler(timeout, handler)
+	}
+
+	if r, ok := ctx.Value(retryHandlerKey{}).(retry); ok && r.attempts > 1 && raw == nil {
+		handler = retryHandler(r.attempts, r.backoff, handler)
+	}
+
+	if tracer, ok := brokerOpts.Context.Value(tracerKey{}).(Tracer); ok && tracer != nil && raw == nil {
+		handler = traceHandler(tracer, handler)
+	}
+
+	if bopts.StartAt == pb.StartPosition_First {
+		n.warnLimited(topic)
+	}
+
+	// a replay of an empty channel would wait for new messages
+	if fail, _ := ctx.Value(failIfEmptyKey{}).(bool); fail && bopts.StartAt != pb.StartPosition_NewOnly {
+		msgs, err := n.ChannelMessages(topic)
+		if err != nil {
+			return nil, err
+		}
+		if msgs == 0 {
+			return nil, ErrEmptyChannel
+		}
+	}
+
+	if dn, ok := brokerOpts.Context.Value(durableKey{}).(string); ok && len(dn) > 0 {
 		stanOpts = append(stanOpts, stan.DurableName(dn))
 		bopts.DurableName = dn
 	}
 
-	fn := func(msg *stan.Msg) {
-		var m broker.Message
-		p := &publication{m: &m, msg: msg, t: msg.Subject}
+	s := &subscriber{
+		t:    topic,
+		opts: opt,
+		b:    n,
+		eh:   brokerOpts.ErrorHandler,
+		quit: make(chan struct{}),
+		gate: &gate{},
+	}
+	if eh, ok := ctx.Value(subscribeErrorHandlerKey{}).(broker.Handler); ok && eh != nil {
+		s.eh = eh
+	}
+	s.events, _ = brokerOpts.Context.Value(logSubscriptionEventsKey{}).(bool)
+
+	// at most once acks every message on receive, nothing is acked afterwards
+	atMostOnce, _ := ctx.Value(atMostOnceKey{}).(bool)
+	if atMostOnce {
+		if !bopts.ManualAcks {
+			stanOpts = append(stanOpts, stan.SetManualAckMode())
+			bopts.ManualAcks = true
+		}
+		ackSuccess = false
+	}
 
-		// unmarshal message
-		if err := n.opts.Codec.Unmarshal(msg.Data, &m); err != nil {
-			p.err = err
-			p.m.Body = msg.Data
+	// with a worker pool, handler timeout or messages buffered for reordering or
+	// compaction stan can't ack when the callback returns, the broker acks in auto
+	// ack mode instead, on dispatch or once the handler completes
+	workers, _ := ctx.Value(workersKey{}).(int)
+	if qw, ok := ctx.Value(queueWorkersKey{}).(int); ok && qw > 0 && len(opt.Queue) > 0 {
+		workers = qw
+	}
+	ordered, _ := ctx.Value(orderedRedeliveryKey{}).(bool)
+	latestKey, _ := ctx.Value(latestPerKeyKey{}).(func(*broker.Message) string)
+	buffered := ordered || latestKey != nil
+	ackMode, _ := ctx.Value(workerAckModeKey{}).(AckMode)
+	var brokerAck, ackOnDispatch bool
+	if (workers > 0 || timeout > 0 || buffered) && !bopts.ManualAcks {
+		stanOpts = append(stanOpts, stan.SetManualAckMode())
+		bopts.ManualAcks = true
+		brokerAck = true
+	}
+	if workers > 0 {
+		ackOnDispatch = ackMode == OnDispatch && (brokerAck || ackSuccess)
+	}
+
+	// the handler acks itself, offsets can be committed instead
+	if bopts.ManualAcks && !ackSuccess && !brokerAck && !atMostOnce {
+		s.offsets = newOffsets()
+	}
+	// a reconnect resumes a non-durable at its lowest unacked message, a raw handler
+	// acks on its own so only the highest received sequence is known
+	if bopts.ManualAcks && !atMostOnce && raw == nil && len(bopts.DurableName) == 0 {
+		s.unacked = newOffsets()
+	}
+
+	if ab, ok := ctx.Value(ackBatchKey{}).(ackBatch); ok && ab.window > 0 && bopts.ManualAcks && !atMostOnce {
+		s.batch = newAckBatcher(ab.window, ab.size)
+	}
+
+	dlq, _ := ctx.Value(deadLetterKey{}).(string)
+
+	collector, _ := brokerOpts.Context.Value(metricsKey{}).(MetricsCollector)
+	labels, _ := ctx.Value(metricLabelsKey{}).(map[string]string)
+	metrics := newSubMetrics(collector, topic, labels)
+
+	// deliver executes the handler for a decoded publication
+	deliver := func(p *publication) {
+		atomic.AddUint64(&s.delivered, 1)
+		atomic.StoreUint64(&s.last, p.msg.Sequence)
+		p.err = handler(p)
+		seq := p.msg.Sequence
+		if p.err != nil {
+			metrics.inc(MetricFailed)
+		} else {
+			metrics.inc(MetricHandled)
+		}
+		n.reportError(p)
+		// timed out messages are left unacked so they are redelivered
+		if p.err == ErrHandlerTimeout {
+			s.handleError(p)
 			return
 		}
-		// execute the handler
-		p.err = handler(p)
+		// permanent failures are acked, after dead lettering if configured
+		if isPermanent(p.err) {
+			if len(dlq) > 0 {
+				if err := n.Publish(dlq, p.m); err != nil {
+					n.logf(log.ErrorLevel, "[stan]: failed to dead letter message of %s: %v", topic, err)
+					s.logEvent(eventError, seq)
+					return
+				}
+			}
+			if bopts.ManualAcks && !ackOnDispatch && !atMostOnce {
+				p.Ack()
+				s.logEvent(eventAck, seq)
+			}
+			return
+		}
+		if ackOnDispatch {
+			return
+		}
+		switch {
 		// if there's no error and success auto ack is enabled ack it
-		if p.err == nil && ackSuccess {
+		case (p.err == nil && ackSuccess) || brokerAck:
+			p.Ack()
+			s.logEvent(eventAck, seq)
+		// stan acks once the callback returned
+		case !bopts.ManualAcks:
+			s.logEvent(eventAck, seq)
+		case p.err != nil && !atMostOnce:
+			s.logEvent(eventNak, seq)
+		}
+	}
+
+	if workers > 0 {
+		work := deliver
+		pool := newWorkerPool(workers, s.quit, func(p *publication) {
+			defer s.inflight.done()
+			work(p)
+		})
+		// a message waiting for a worker when the subscription stops is left
+		// unacked so it is redelivered
+		deliver = func(p *publication) {
+			s.inflight.add()
+			if !pool.dispatch(p) {
+				s.inflight.done()
+				return
+			}
+			if ackOnDispatch {
+				p.Ack()
+				s.logEvent(eventAck, p.msg.Sequence)
+			}
+		}
+	}
+
+	if ordered {
+		deliver = newReorderer(deliver).handle
+	}
+
+	if latestKey != nil {
+		deliver = newCompactor(latestKey, time.Now().UnixNano(), bopts.ManualAcks, deliver).handle
+	}
+
+	var gaps *gapDetector
+	if fn, ok := ctx.Value(detectGapsKey{}).(func(expected, got uint64)); ok && fn != nil {
+		gaps = newGapDetector(fn)
+	}
+
+	decode, _ := ctx.Value(decodeFuncKey{}).(func(subject string, data []byte) (*broker.Message, error))
+
+	control, _ := ctx.Value(controlMessageKey{}).(func(map[string]string))
+	match, _ := ctx.Value(matchHeadersKey{}).(map[string]string)
+	ttl, _ := ctx.Value(respectTTLKey{}).(bool)
+	var tokens subjectPattern
+	if pattern, ok := ctx.Value(extractSubjectTokensKey{}).(string); ok && len(pattern) > 0 {
+		tokens = parseSubjectPattern(pattern)
+	}
+
+	// skip acks a message that isn't passed to the handler, in manual ack mode
+	// it would be redelivered otherwise
+	manual := bopts.ManualAcks && !atMostOnce
+	skip := func(msg *stan.Msg) {
+		if !manual {
+			return
+		}
+		if s.unacked != nil {
+			s.unacked.acked(msg)
+		}
+		if s.batch != nil {
+			s.batch.add(msg)
+			return
+		}
+		msg.Ack()
+	}
+
+	fn := func(msg *stan.Msg) {
+		s.gate.wait(s.quit)
+
+		// in-flight callbacks are counted so a drain can wait for them
+		s.inflight.add()
+		defer s.inflight.done()
+		select {
+		case <-s.quit:
+			// closed while waiting, leave the message unacked for redelivery
+			return
+		default:
+		}
+
+		metrics.inc(MetricReceived)
+		if msg.Redelivered {
+			n.stats.redelivered(msg.Subject)
+		}
+		if gaps != nil {
+			gaps.observe(msg)
+		}
+		for last := atomic.LoadUint64(&s.received); msg.Sequence > last; last = atomic.LoadUint64(&s.received) {
+			if atomic.CompareAndSwapUint64(&s.received, last, msg.Sequence) {
+				break
+			}
+		}
+		if s.unacked != nil {
+			s.unacked.add(msg)
+		}
+		if atMostOnce {
 			msg.Ack()
+			s.logEvent(eventAck, msg.Sequence)
+		}
+		// sentinels of CreateChannelsOnConnect aren't messages
+		if isChannelSentinel(msg.Data) {
+			skip(msg)
+			return
+		}
+		// empty payloads are keepalives unless AllowEmptyPayloads passes them on
+		if len(msg.Data) == 0 && !allowEmpty {
+			skip(msg)
+			return
+		}
+		if maxAge > 0 && msg.Timestamp < time.Now().Add(-maxAge).UnixNano() {
+			skip(msg)
+			return
+		}
+		// oversized payloads aren't decoded, the error handler gets an empty message
+		if maxSize > 0 && len(msg.Data) > maxSize {
+			p := &publication{t: msg.Subject, msg: msg, m: &broker.Message{}, err: ErrMessageTooLarge, sub: s}
+			s.handleError(p)
+			n.reportError(p)
+			skip(msg)
+			return
+		}
+
+		if raw != nil {
+			if err := raw(msg); err != nil {
+				n.logf(log.ErrorLevel, "[stan]: raw handler of %s failed: %v", topic, err)
+				s.logEvent(eventNak, msg.Sequence)
+			}
+			return
+		}
+
+		p, err := n.decode(msg, decode)
+		p.sub = s
+		p.batch = s.batch
+		p.offsets = s.offsets
+		if codecCheck && atomic.CompareAndSwapInt32(&codecChecked, 0, 1) && err != nil && err != ErrInvalidSignature {
+			mismatch(topic, err)
+		}
+		if err != nil {
+			s.handleError(p)
+			n.reportError(p)
+			// tampered messages won't verify on redelivery either
+			if err == ErrInvalidSignature {
+				skip(msg)
+			}
+			return
+		}
+		if tokens != nil {
+			p.m.Header = tokens.extract(msg.Subject, p.m.Header)
+		}
+		if window != nil && window.stale(msg, time.Now()) {
+			skip(msg)
+			return
+		}
+		if !matchHeaders(p.m.Header, match) || (ttl && expired(p.m.Header, time.Now())) {
+			skip(msg)
+			return
+		}
+		// header only messages bypass the handler
+		if control != nil && len(p.m.Body) == 0 {
+			control(p.m.Header)
+			skip(msg)
+			return
+		}
+		if s.offsets != nil {
+			s.offsets.add(msg)
+		}
+		deliver(p)
+	}
+
+	// recreating the durable at the last message discards the backlog
+	if resume, _ := ctx.Value(resumeAtLatestKey{}).(bool); resume && len(bopts.DurableName) > 0 {
+		if err := n.closeDurable(topic, bopts.DurableName, opt.Queue); err != nil {
+			return nil, err
+		}
+		stanOpts = append(stanOpts, stan.StartWithLastReceived())
+	}
+
+	s.fn = fn
+	s.sopts = stanOpts
+	s.durable = bopts.DurableName
+	s.dq = len(bopts.DurableName) > 0
+
+	n.RLock()
+	sub, err := s.subscribe(n.conn)
+	n.RUnlock()
+	if err != nil {
+		s.stopAcks()
+		return nil, err
+	}
+	s.mu.Lock()
+	s.s = sub
+	s.mu.Unlock()
+
+	n.Lock()
+	n.subs[s] = struct{}{}
+	n.Unlock()
+
+	if alert, ok := ctx.Value(lagAlertKey{}).(lagAlert); ok && alert.cb != nil {
+		go s.watchLag(alert)
+	}
+
+	s.logEvent(eventSubscribe, 0)
+	return s, nil
+}
+
+// SubscribeAll subscribes handler to every topic with the same options. If any
+// subscription fails the ones already created are unsubscribed.
+func (n *stanBroker) SubscribeAll(topics []string, handler broker.Handler, opts ...broker.SubscribeOption) ([]broker.Subscriber, error) {
+	subs := make([]broker.Subscriber, 0, len(topics))
+	for _, topic := range topics {
+		sub, err := n.Subscribe(topic, handler, opts...)
+		if err != nil {
+			for _, s := range subs {
+				s.Unsubscribe()
+			}
+			return nil, fmt.Errorf("[stan]: failed to subscribe to %s: %v", topic, err)
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// multiSubscriber groups the subscriptions created by MultiSubscribe
+type multiSubscriber struct {
+	topics []string
+	subs   []broker.Subscriber
+}
+
+func (m *multiSubscriber) Options() broker.SubscribeOptions {
+	return m.subs[0].Options()
+}
+
+func (m *multiSubscriber) Topic() string {
+	return strings.Join(m.topics, ",")
+}
+
+// Unsubscribe closes every underlying subscription and returns the first error
+func (m *multiSubscriber) Unsubscribe() error {
+	var err error
+	for _, s := range m.subs {
+		if uerr := s.Unsubscribe(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+	return err
+}
+
+// MultiSubscribe subscribes handler to every topic and returns a single subscriber
+// for all of them, the handler tells the topics apart by Event.Topic
+func (n *stanBroker) MultiSubscribe(topics []string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	if len(topics) == 0 {
+		return nil, errors.New("[stan]: no topics to subscribe to")
+	}
+	subs, err := n.SubscribeAll(topics, handler, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &multiSubscriber{topics: topics, subs: subs}, nil
+}
+
+// SubscribeOnce subscribes to topic and returns the first message received, or the
+// context error if it is done first. The subscription is removed before returning.
+func (n *stanBroker) SubscribeOnce(ctx context.Context, topic string, opts ...broker.SubscribeOption) (broker.Event, error) {
+	ch := make(chan broker.Event, 1)
+	sub, err := n.Subscribe(topic, func(e broker.Event) error {
+		select {
+		case ch <- e:
+		default:
+		}
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	select {
+	case e := <-ch:
+		return e, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// UpdateSubscription changes the stan options of a durable subscription created by
+// this broker, e.g. its MaxInflight or AckWait. The durable is closed rather than
+// unsubscribed and resumed with the new options, so it keeps its position and
+// unacked messages are redelivered. Only options set with SubscribeOption apply,
+// the durable name, queue group and start position can't be changed.
+func (n *stanBroker) UpdateSubscription(sub broker.Subscriber, opts ...broker.SubscribeOption) error {
+	s, ok := sub.(*subscriber)
+	if !ok || s.b != n {
+		return errors.New("[stan]: not a subscription of this broker")
+	}
+	if !s.dq {
+		return errors.New("[stan]: only durable subscriptions can be updated")
+	}
+
+	var opt broker.SubscribeOptions
+	for _, o := range opts {
+		o(&opt)
+	}
+	var extra []stan.SubscriptionOption
+	if opt.Context != nil {
+		extra, _ = opt.Context.Value(subscribeOptionKey{}).([]stan.SubscriptionOption)
+	}
+
+	n.RLock()
+	conn := n.conn
+	n.RUnlock()
+	if conn == nil {
+		return errors.New("not connected")
+	}
+	return s.update(conn, extra)
+}
+
+// PromoteToDurable turns a subscription created by this broker into a durable named
+// durableName that resumes after the last message it received. The durable is
+// created before the old subscription is removed, messages received in between are
+// delivered twice. A subscription that received nothing yet starts with new messages.
+func (n *stanBroker) PromoteToDurable(sub broker.Subscriber, durableName string) error {
+	s, ok := sub.(*subscriber)
+	if !ok || s.b != n {
+		return errors.New("[stan]: not a subscription of this broker")
+	}
+	if len(durableName) == 0 {
+		return errors.New("[stan]: durable name required")
+	}
+
+	n.RLock()
+	conn := n.conn
+	n.RUnlock()
+	if conn == nil {
+		return errors.New("not connected")
+	}
+	return s.promote(conn, durableName)
+}
+
+// defaultReplayIdle ends a replay that received nothing for as long unless ReplayIdle
+// is set
+const defaultReplayIdle = time.Second
+
+// ReplayIncompleteError is returned by ReplayRange when no message arrived within the
+// ReplayIdle time before endSeq was forwarded, e.g. the channel ends before it
+type ReplayIncompleteError struct {
+	// Last is the last forwarded sequence, 0 if none was
+	Last uint64
+	End  uint64
+}
+
+func (e *ReplayIncompleteError) Error() string {
+	return fmt.Sprintf("[stan]: replay stopped at sequence %d before %d", e.Last, e.End)
+}
+
+// ReplayRange republishes the messages of srcTopic with sequences startSeq through
+// endSeq to dstTopic, e.g. to backfill a derived store. Payloads are forwarded as
+// stored. It returns once endSeq was forwarded, a ReplayIncompleteError if the replay
+// went idle before, e.g. at the last message of a channel ending before endSeq, and
+// the error of ctx if it is done first.
+func (n *stanBroker) ReplayRange(ctx context.Context, srcTopic, dstTopic string, startSeq, endSeq uint64) error {
+	if startSeq == 0 || endSeq < startSeq {
+		return fmt.Errorf("invalid replay range %d-%d", startSeq, endSeq)
+	}
+
+	n.RLock()
+	conn := n.conn
+	opts := n.opts.Context
+	n.RUnlock()
+	if conn == nil {
+		return errors.New("not connected")
+	}
+	replayIdle, _ := opts.Value(replayIdleKey{}).(time.Duration)
+	if replayIdle <= 0 {
+		replayIdle = defaultReplayIdle
+	}
+	srcTopic = subjectName(opts, srcTopic)
+	dstTopic = subjectName(opts, dstTopic)
+
+	const inflight = 64
+	msgs := make(chan *stan.Msg, inflight)
+	done := make(chan struct{})
+	defer close(done)
+
+	sub, err := conn.Subscribe(srcTopic, func(msg *stan.Msg) {
+		select {
+		case msgs <- msg:
+		case <-done:
+		}
+	}, stan.StartAtSequence(startSeq), stan.SetManualAckMode(), stan.MaxInflight(inflight))
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	idle := time.NewTimer(replayIdle)
+	defer idle.Stop()
+	var last uint64
+	for {
+		select {
+		case msg := <-msgs:
+			if msg.Sequence > endSeq {
+				return nil
+			}
+			if err := conn.Publish(dstTopic, msg.Data); err != nil {
+				return err
+			}
+			msg.Ack()
+			last = msg.Sequence
+			if msg.Sequence == endSeq {
+				return nil
+			}
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(replayIdle)
+		case <-idle.C:
+			return &ReplayIncompleteError{Last: last, End: endSeq}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ResetDurable repositions a durable subscription. STAN only honours the start
+// position when a durable is created, so the durable is removed and created again at
+// start. A durable subscribed through this broker keeps its handler and is resumed
+// immediately, otherwise the durable is created and closed so the next subscriber
+// resumes from start. The reset is not atomic, messages published in between are
+// only delivered if start includes them.
+func (n *stanBroker) ResetDurable(topic, durableName, queue string, start StartPosition) error {
+	topic = subjectName(n.opts.Context, topic)
+	var s *subscriber
+	n.RLock()
+	conn := n.conn
+	for sub := range n.subs {
+		if sub.t == topic && sub.durable == durableName && sub.opts.Queue == queue {
+			s = sub
+			break
+		}
+	}
+	n.RUnlock()
+	if conn == nil {
+		return errors.New("not connected")
+	}
+
+	if s == nil {
+		if err := n.closeDurable(topic, durableName, queue); err != nil {
+			return err
+		}
+		opts := []stan.SubscriptionOption{stan.DurableName(durableName), stan.SetManualAckMode(), stan.SubscriptionOption(start)}
+		fn := func(msg *stan.Msg) {}
+		var sub stan.Subscription
+		var err error
+		if len(queue) > 0 {
+			sub, err = conn.QueueSubscribe(topic, queue, fn, opts...)
+		} else {
+			sub, err = conn.Subscribe(topic, fn, opts...)
+		}
+		if err != nil {
+			return err
+		}
+		return sub.Close()
+	}
+
+	return s.reset(conn, stan.SubscriptionOption(start))
+}
+
+// DrainQueueGroup hands the work of this instance's queue subscriptions over to the
+// other members of their queue groups, e.g. during a rolling deploy. New messages are
+// no longer passed to the handlers, in-flight handlers, including those running on
+// Workers, are given up to timeout to complete, then the subscriptions are closed and the server redelivers their
+// unacked messages to the remaining members.
+func (n *stanBroker) DrainQueueGroup(timeout time.Duration) error {
+	var subs []*subscriber
+	n.RLock()
+	for s := range n.subs {
+		if len(s.opts.Queue) > 0 {
+			subs = append(subs, s)
+		}
+	}
+	n.RUnlock()
+
+	for _, s := range subs {
+		s.gate.pause()
+	}
+
+	deadline := time.After(timeout)
+	for _, s := range subs {
+		select {
+		case <-s.idle():
+		case <-deadline:
 		}
 	}
 
-	var sub stan.Subscription
 	var err error
+	for _, s := range subs {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Subscriptions returns a snapshot of the active subscribers
+func (n *stanBroker) Subscriptions() []broker.Subscriber {
+	n.RLock()
+	defer n.RUnlock()
+
+	subs := make([]broker.Subscriber, 0, len(n.subs))
+	for s := range n.subs {
+		subs = append(subs, s)
+	}
+	return subs
+}
 
+// CloseDurable removes the durable subscription with the given name from the server.
+// STAN has no API to delete a durable, it has to be resumed and then unsubscribed,
+// which is what this method does. The durable must not be in use by another subscriber.
+func (n *stanBroker) CloseDurable(topic, durableName, queue string) error {
+	return n.closeDurable(subjectName(n.opts.Context, topic), durableName, queue)
+}
+
+// closeDurable removes the durable of an already named subject
+func (n *stanBroker) closeDurable(topic, durableName, queue string) error {
 	n.RLock()
-	if len(opt.Queue) > 0 {
-		sub, err = n.conn.QueueSubscribe(topic, opt.Queue, fn, stanOpts...)
+	defer n.RUnlock()
+	if n.conn == nil {
+		return errors.New("not connected")
+	}
+
+	// manual ack mode avoids acking pending messages delivered on resume
+	opts := []stan.SubscriptionOption{stan.DurableName(durableName), stan.SetManualAckMode()}
+	fn := func(msg *stan.Msg) {}
+
+	var sub stan.Subscription
+	var err error
+	if len(queue) > 0 {
+		sub, err = n.conn.QueueSubscribe(topic, queue, fn, opts...)
 	} else {
-		sub, err = n.conn.Subscribe(topic, fn, stanOpts...)
+		sub, err = n.conn.Subscribe(topic, fn, opts...)
 	}
-	n.RUnlock()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &subscriber{dq: len(bopts.DurableName) > 0, s: sub, opts: opt, t: topic}, nil
+	return sub.Unsubscribe()
 }
 
 func (n *stanBroker) String() string {
@@ -389,20 +2156,21 @@ func NewBroker(opts ...broker.Option) broker.Broker {
 		o(&options)
 	}
 
-	stanOpts := stan.GetDefaultOptions()
-	if n, ok := options.Context.Value(optionsKey{}).(stan.Options); ok {
-		stanOpts = n
-	}
+	raw, _ := options.Context.Value(optionsKey{}).(stan.Options)
+	stanOpts := mergeStanOptions(raw)
 
 	if len(options.Addrs) == 0 {
 		options.Addrs = strings.Split(stanOpts.NatsURL, ",")
 	}
 
 	nb := &stanBroker{
-		done:  make(chan struct{}),
-		opts:  options,
-		sopts: stanOpts,
-		addrs: setAddrs(options.Addrs),
+		done:      make(chan struct{}),
+		opts:      options,
+		sopts:     stanOpts,
+		addrs:     setAddrs(options.Addrs),
+		subs:      make(map[*subscriber]struct{}),
+		stats:     newStats(),
+		connectFn: connectStan,
 	}
 
 	return nb
@@ -1,14 +1,99 @@
 package stan
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/micro/go-micro/v2/broker"
+	natsd "github.com/nats-io/nats-server/v2/server"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	nats "github.com/nats-io/nats.go"
 	stan "github.com/nats-io/stan.go"
 )
 
+const testClusterID = "test-cluster"
+
+// freePort returns a free local tcp port
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// runServer starts an embedded streaming server on a random port and returns its address
+func runServer(t *testing.T) (string, func()) {
+	return runServerWith(t, nil)
+}
+
+// runServerWith starts an embedded streaming server after applying configure to its options
+func runServerWith(t *testing.T, configure func(*stand.Options, *natsd.Options)) (string, func()) {
+	nopts := stand.DefaultNatsServerOptions
+	nopts.Host = "127.0.0.1"
+	nopts.Port = freePort(t)
+
+	sopts := stand.GetDefaultOptions()
+	sopts.ID = testClusterID
+
+	if configure != nil {
+		configure(sopts, &nopts)
+	}
+
+	s, err := stand.RunServerWithOpts(sopts, &nopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("127.0.0.1:%d", nopts.Port), s.Shutdown
+}
+
+// runMonitoredServer starts an embedded streaming server with monitoring enabled
+// and returns its address and monitoring url
+func runMonitoredServer(t *testing.T, configure func(*stand.Options)) (string, string, func()) {
+	port := freePort(t)
+	addr, shutdown := runServerWith(t, func(sopts *stand.Options, nopts *natsd.Options) {
+		nopts.HTTPHost = "127.0.0.1"
+		nopts.HTTPPort = port
+		if configure != nil {
+			configure(sopts)
+		}
+	})
+	return addr, fmt.Sprintf("http://127.0.0.1:%d", port), shutdown
+}
+
+// newTestBroker returns a broker connected to the given address
+func newTestBroker(t *testing.T, addr string, opts ...broker.Option) *stanBroker {
+	opts = append([]broker.Option{ClusterID(testClusterID), broker.Addrs(addr)}, opts...)
+	b := NewBroker(opts...).(*stanBroker)
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// receive waits for the next message body on ch
+func receive(t *testing.T, ch <-chan string) string {
+	select {
+	case body := <-ch:
+		return body
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for message")
+	}
+	return ""
+}
+
 var addrTestCases = []struct {
 	name        string
 	description string
@@ -95,3 +180,2482 @@ func TestInitAddrs(t *testing.T) {
 
 	}
 }
+
+// TestReconnectCBCoalesce ensures concurrent connection lost callbacks run a single connect loop
+func TestReconnectCBCoalesce(t *testing.T) {
+	b := NewBroker(ClusterID("test-cluster"), broker.Addrs("127.0.0.1:1")).(*stanBroker)
+	b.connectRetry = true
+	b.clusterID = "test-cluster"
+	b.clientID = "test-client"
+	b.nopts = []stan.Option{stan.NatsURL("nats://127.0.0.1:1")}
+
+	calls := 50
+	returned := make(chan struct{}, calls)
+	for i := 0; i < calls; i++ {
+		go func() {
+			b.reconnectCB(nil, errors.New("connection lost"))
+			returned <- struct{}{}
+		}()
+	}
+
+	// every callback except the one running the connect loop returns immediately
+	for i := 0; i < calls-1; i++ {
+		select {
+		case <-returned:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected %d callbacks to return, got %d", calls-1, i)
+		}
+	}
+
+	select {
+	case <-returned:
+		t.Fatal("Expected a single connect loop to keep running")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected connect loop to stop after Disconnect")
+	}
+}
+
+func TestCloseDurable(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan string, 10)
+	handler := func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}
+	durable := SubscribeOptions().Durable("durable").Build()
+
+	sub, err := b.Subscribe("test", handler, durable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("first")}); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, ch); body != "first" {
+		t.Fatalf("Expected %q, got %q", "first", body)
+	}
+	// closes the durable, keeping its interest on the server
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	// published while the durable is offline, would be delivered on resume
+	if err := b.Publish("test", &broker.Message{Body: []byte("backlog")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.CloseDurable("test", "durable", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Subscribe("test", handler, durable); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("fresh")}); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, ch); body != "fresh" {
+		t.Fatalf("Expected durable to start fresh with %q, got %q", "fresh", body)
+	}
+}
+
+func TestPublishMiddleware(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	var order []string
+	mw := func(name string) PublishWrapper {
+		return func(next PublishFunc) PublishFunc {
+			return func(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+				order = append(order, name)
+				if msg.Header == nil {
+					msg.Header = make(map[string]string)
+				}
+				msg.Header["X-Middleware"] = name
+				return next(topic, msg, opts...)
+			}
+		}
+	}
+
+	b := newTestBroker(t, addr, PublishMiddleware(mw("outer"), mw("inner")))
+	defer b.Disconnect()
+
+	ch := make(chan string, 1)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- e.Message().Header["X-Middleware"]
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := receive(t, ch); v != "inner" {
+		t.Errorf("Expected header set by inner middleware, got %q", v)
+	}
+	if strings.Join(order, ",") != "outer,inner" {
+		t.Errorf("Expected middleware order outer,inner, got %v", order)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	handler := func(e broker.Event) error { return nil }
+	var subs []broker.Subscriber
+	for _, topic := range []string{"a", "b", "c"} {
+		sub, err := b.Subscribe(topic, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	active := b.Subscriptions()
+	if len(active) != 3 {
+		t.Fatalf("Expected 3 subscriptions, got %d", len(active))
+	}
+	var topics []string
+	for _, sub := range active {
+		topics = append(topics, sub.Topic())
+	}
+	sort.Strings(topics)
+	if strings.Join(topics, ",") != "a,b,c" {
+		t.Errorf("Expected topics a,b,c, got %v", topics)
+	}
+
+	if err := subs[0].Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if l := len(b.Subscriptions()); l != 2 {
+		t.Errorf("Expected 2 subscriptions after unsubscribe, got %d", l)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+
+	handler := func(e broker.Event) error { return nil }
+	if _, err := b.Subscribe("test", handler); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe("test", handler, SubscribeOptions().Durable("durable").Build()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("pending")}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(b.Subscriptions()); l != 0 {
+		t.Errorf("Expected no subscriptions after shutdown, got %d", l)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("closed")}); err == nil {
+		t.Error("Expected publish to fail after shutdown")
+	}
+}
+
+func TestOnControlMessage(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan string, 2)
+	control := make(chan string, 2)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, OnControlMessage(func(header map[string]string) {
+		control <- header["Command"]
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("test", &broker.Message{Header: map[string]string{"Command": "flush"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd := receive(t, control); cmd != "flush" {
+		t.Errorf("Expected control message %q, got %q", "flush", cmd)
+	}
+	if body := receive(t, ch); body != "data" {
+		t.Errorf("Expected handler to receive %q, got %q", "data", body)
+	}
+}
+
+func TestSubscribeAll(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan string, 3)
+	topics := []string{"tenant.a", "tenant.b", "tenant.c"}
+	subs, err := b.SubscribeAll(topics, func(e broker.Event) error {
+		ch <- e.Topic() + ":" + string(e.Message().Body)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 3 {
+		t.Fatalf("Expected 3 subscribers, got %d", len(subs))
+	}
+
+	for _, topic := range topics {
+		if err := b.Publish(topic, &broker.Message{Body: []byte("hello")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for range topics {
+		got = append(got, receive(t, ch))
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != "tenant.a:hello,tenant.b:hello,tenant.c:hello" {
+		t.Errorf("Expected every tenant to receive its message, got %v", got)
+	}
+}
+
+func TestSubscribeAllRollback(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	// the same durable can't be registered twice by a client, so the last subscribe fails
+	topics := []string{"tenant.a", "tenant.b", "tenant.a"}
+	_, err := b.SubscribeAll(topics, func(e broker.Event) error { return nil },
+		SubscribeOptions().Durable("durable").Build())
+	if err == nil {
+		t.Fatal("Expected SubscribeAll to fail")
+	}
+	if l := len(b.Subscriptions()); l != 0 {
+		t.Errorf("Expected subscriptions to be rolled back, got %d", l)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan string, 3)
+	sub, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub.(*subscriber).Pause()
+	for i := 0; i < 3; i++ {
+		if err := b.Publish("test", &broker.Message{Body: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case body := <-ch:
+		t.Fatalf("Expected no delivery while paused, got %q", body)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	sub.(*subscriber).Resume()
+	for i := 0; i < 3; i++ {
+		if body := receive(t, ch); body != fmt.Sprint(i) {
+			t.Errorf("Expected %q, got %q", fmt.Sprint(i), body)
+		}
+	}
+}
+
+func TestDrainQueueGroup(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	draining := newTestBroker(t, addr)
+	defer draining.Disconnect()
+	taking := newTestBroker(t, addr)
+	defer taking.Disconnect()
+
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	record := func(e broker.Event) {
+		mu.Lock()
+		seen[string(e.Message().Body)] = true
+		mu.Unlock()
+	}
+
+	handled := make(chan struct{}, 100)
+	if _, err := draining.Subscribe("test", func(e broker.Event) error {
+		time.Sleep(20 * time.Millisecond)
+		record(e)
+		handled <- struct{}{}
+		return nil
+	}, broker.Queue("workers")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := taking.Subscribe("test", func(e broker.Event) error {
+		time.Sleep(20 * time.Millisecond)
+		record(e)
+		return nil
+	}, broker.Queue("workers")); err != nil {
+		t.Fatal(err)
+	}
+
+	count := 20
+	for i := 0; i < count; i++ {
+		if err := draining.Publish("test", &broker.Message{Body: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	<-handled
+	if err := draining.DrainQueueGroup(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if l := len(draining.Subscriptions()); l != 0 {
+		t.Errorf("Expected drained subscriptions to be closed, got %d", l)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		l := len(seen)
+		mu.Unlock()
+		if l == count {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected all %d messages to be handled, got %d", count, l)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestResetDurable(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan string, 10)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, SubscribeOptions().Durable("durable").Build()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if err := b.Publish("test", &broker.Message{Body: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		receive(t, ch)
+	}
+
+	if err := b.ResetDurable("test", "durable", "", StartAtSequence(1)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if body := receive(t, ch); body != fmt.Sprint(i) {
+			t.Errorf("Expected replay of %d, got %q", i, body)
+		}
+	}
+}
+
+func TestDefaultSubscribeOptions(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	defaultErrs := make(chan error, 1)
+	b := newTestBroker(t, addr, DefaultSubscribeOptions(
+		broker.Queue("defaults"),
+		SubscribeErrorHandler(func(e broker.Event) error {
+			defaultErrs <- e.Error()
+			return nil
+		}),
+	))
+	defer b.Disconnect()
+
+	handler := func(e broker.Event) error { return nil }
+	sub, err := b.Subscribe("test", handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := sub.Options().Queue; q != "defaults" {
+		t.Errorf("Expected default queue, got %q", q)
+	}
+
+	overrideErrs := make(chan error, 1)
+	sub, err = b.Subscribe("test", handler, broker.Queue("override"), SubscribeErrorHandler(func(e broker.Event) error {
+		overrideErrs <- e.Error()
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := sub.Options().Queue; q != "override" {
+		t.Errorf("Expected per call queue to override default, got %q", q)
+	}
+
+	// not decodable by the json codec
+	if err := b.conn.Publish("test", []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	for _, errs := range []chan error{defaultErrs, overrideErrs} {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Error("Expected decode error")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for error handler")
+		}
+	}
+}
+
+func TestReconnectAfterDisconnect(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+
+	ch := make(chan string, 1)
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			if err := b.Connect(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := b.Subscribe("test", func(e broker.Event) error {
+			ch <- string(e.Message().Body)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Publish("test", &broker.Message{Body: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+		if body := receive(t, ch); body != fmt.Sprint(i) {
+			t.Errorf("Expected %q, got %q", fmt.Sprint(i), body)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- b.Disconnect()
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Disconnect hangs")
+		}
+		if b.done != nil {
+			t.Error("Expected done channel to be closed on Disconnect")
+		}
+	}
+}
+
+func TestMatchHeaders(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan string, 4)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, AckOnSuccess(), MatchHeaders(map[string]string{"Region": "eu", "Type": "order"})); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []*broker.Message{
+		{Header: map[string]string{"Region": "us", "Type": "order"}, Body: []byte("us order")},
+		{Header: map[string]string{"Region": "eu"}, Body: []byte("eu")},
+		{Header: map[string]string{"Region": "eu", "Type": "order", "Id": "1"}, Body: []byte("eu order")},
+	}
+	for _, msg := range msgs {
+		if err := b.Publish("test", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if body := receive(t, ch); body != "eu order" {
+		t.Errorf("Expected only the matching message, got %q", body)
+	}
+	select {
+	case body := <-ch:
+		t.Errorf("Unexpected message %q", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestResumeAtLatest(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, DurableName("snapshot"))
+	defer b.Disconnect()
+
+	ch := make(chan string, 4)
+	handler := func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}
+
+	sub, err := b.Subscribe("test", handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if err := b.Publish("test", &broker.Message{Body: []byte(fmt.Sprintf("state-%d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := b.Subscribe("test", handler, ResumeAtLatest(true)); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, ch); body != "state-3" {
+		t.Errorf("Expected the latest message on resume, got %q", body)
+	}
+	select {
+	case body := <-ch:
+		t.Errorf("Unexpected backlog message %q", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestConnectWait(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, ConnectWait(7*time.Second))
+	defer b.Disconnect()
+
+	var opts stan.Options
+	for _, o := range b.nopts {
+		if err := o(&opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if opts.ConnectTimeout != 7*time.Second {
+		t.Errorf("Expected ConnectWait of 7s, got %v", opts.ConnectTimeout)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, CircuitBreaker(2, 200*time.Millisecond))
+	if err := b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &broker.Message{Body: []byte("hello")}
+	for i := 0; i < 2; i++ {
+		if err := b.Publish("test", msg); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("Expected a publish failure, got %v", err)
+		}
+	}
+	if err := b.Publish("test", msg); err != ErrCircuitOpen {
+		t.Fatalf("Expected the breaker to open, got %v", err)
+	}
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect()
+	if err := b.Publish("test", msg); err != ErrCircuitOpen {
+		t.Fatalf("Expected the breaker to stay open until reset, got %v", err)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if err := b.Publish("test", msg); err != nil {
+		t.Fatalf("Expected the half open trial to succeed, got %v", err)
+	}
+	if err := b.Publish("test", msg); err != nil {
+		t.Fatalf("Expected the breaker to close, got %v", err)
+	}
+}
+
+func TestMultiSubscribe(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan string, 3)
+	topics := []string{"orders", "payments", "refunds"}
+	sub, err := b.MultiSubscribe(topics, func(e broker.Event) error {
+		ch <- e.Topic() + ":" + string(e.Message().Body)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Topic() != "orders,payments,refunds" {
+		t.Errorf("Unexpected topic %q", sub.Topic())
+	}
+
+	for _, topic := range topics {
+		if err := b.Publish(topic, &broker.Message{Body: []byte(topic)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for range topics {
+		got = append(got, receive(t, ch))
+	}
+	sort.Strings(got)
+	for i, topic := range topics {
+		if got[i] != topic+":"+topic {
+			t.Errorf("Expected message of %s to carry its topic, got %q", topic, got[i])
+		}
+	}
+
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if subs := b.Subscriptions(); len(subs) != 0 {
+		t.Errorf("Expected all subscriptions closed, got %d", len(subs))
+	}
+}
+
+func TestReady(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	var mu sync.Mutex
+	var transitions []bool
+	b := newTestBroker(t, addr, ConnectRetry(true), Readiness(func(ready bool) {
+		mu.Lock()
+		transitions = append(transitions, ready)
+		mu.Unlock()
+	}))
+	if !b.Ready() {
+		t.Error("Expected broker to be ready after Connect")
+	}
+
+	// simulate a lost connection, the broker reconnects to the running server
+	b.RLock()
+	conn := b.conn
+	b.RUnlock()
+	conn.Close()
+	b.connectionLost(conn, errors.New("connection lost"))
+	if !b.Ready() {
+		t.Error("Expected broker to be ready after reconnect")
+	}
+
+	if err := b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Ready() {
+		t.Error("Expected broker not to be ready after Disconnect")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(transitions) != "[true false true false]" {
+		t.Errorf("Unexpected readiness transitions %v", transitions)
+	}
+}
+
+func TestRespectTTL(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan string, 4)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, AckOnSuccess(), RespectTTL(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339Nano)
+	future := time.Now().Add(time.Minute).Format(time.RFC3339Nano)
+	msgs := []*broker.Message{
+		{Header: map[string]string{ExpiresHeader: past}, Body: []byte("stale")},
+		{Header: map[string]string{ExpiresHeader: future}, Body: []byte("fresh")},
+		{Body: []byte("no ttl")},
+	}
+	for _, msg := range msgs {
+		if err := b.Publish("test", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{"fresh", "no ttl"} {
+		if body := receive(t, ch); body != want {
+			t.Errorf("Expected %q, got %q", want, body)
+		}
+	}
+	select {
+	case body := <-ch:
+		t.Errorf("Unexpected message %q", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileCheckpointStore(dir)
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan string, 4)
+	handler := func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}
+	opts := []broker.SubscribeOption{Checkpoint(store), SubscribeOption(stan.DeliverAllAvailable())}
+
+	for _, body := range []string{"1", "2"} {
+		if err := b.Publish("test", &broker.Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub, err := b.Subscribe("test", handler, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1", "2"} {
+		if body := receive(t, ch); body != want {
+			t.Fatalf("Expected %q, got %q", want, body)
+		}
+	}
+	// the checkpoint is saved once the handler returned
+	deadline := time.Now().Add(5 * time.Second)
+	for seq, _ := store.Load("test"); seq != 2; seq, _ = store.Load("test") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected checkpoint 2, got %d", seq)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted subscriber resumes after the checkpoint
+	if err := b.Publish("test", &broker.Message{Body: []byte("3")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe("test", handler, opts...); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, ch); body != "3" {
+		t.Errorf("Expected to resume at the message after the checkpoint, got %q", body)
+	}
+}
+
+func TestCheckpointManualAckHolds(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileCheckpointStore(dir)
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	// manual acks set through the stan options keep a failed message back too
+	ch := make(chan string, 1)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return errors.New("temporarily unavailable")
+	}, Checkpoint(store), SubscribeOption(stan.SetManualAckMode(), stan.AckWait(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, ch)
+	time.Sleep(200 * time.Millisecond)
+
+	if seq, err := store.Load("test"); err != nil || seq != 0 {
+		t.Errorf("Expected no checkpoint for a failed message, got %d, %v", seq, err)
+	}
+}
+
+func TestPermanentError(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	dead := make(chan string, 2)
+	if _, err := b.Subscribe("test.dlq", func(e broker.Event) error {
+		dead <- string(e.Message().Body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	ch := make(chan string, 8)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		body := string(e.Message().Body)
+		mu.Lock()
+		seen[body]++
+		n := seen[body]
+		mu.Unlock()
+		ch <- body
+		if body == "bad" {
+			return Permanent(errors.New("invalid payload"))
+		}
+		if n == 1 {
+			return errors.New("temporarily unavailable")
+		}
+		return nil
+	}, AckOnSuccess(), DeadLetter("test.dlq"), SubscribeOption(stan.AckWait(time.Second))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"bad", "flaky"} {
+		if err := b.Publish("test", &broker.Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if body := receive(t, dead); body != "bad" {
+		t.Errorf("Expected the permanent failure to be dead lettered, got %q", body)
+	}
+	// wait for the transient failure to be redelivered
+	for i := 0; i < 3; i++ {
+		receive(t, ch)
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if seen["bad"] != 1 {
+		t.Errorf("Expected the permanent failure to be acked, got %d deliveries", seen["bad"])
+	}
+	if seen["flaky"] != 2 {
+		t.Errorf("Expected the transient failure to be redelivered once, got %d deliveries", seen["flaky"])
+	}
+}
+
+func TestSubscribeOnce(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	for _, body := range []string{"first", "second"} {
+		if err := b.Publish("test", &broker.Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e, err := b.SubscribeOnce(ctx, "test", SubscribeOption(stan.DeliverAllAvailable()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := string(e.Message().Body); body != "first" {
+		t.Errorf("Expected the first message, got %q", body)
+	}
+	if subs := b.Subscriptions(); len(subs) != 0 {
+		t.Errorf("Expected the subscription to be removed, got %d", len(subs))
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := b.SubscribeOnce(ctx, "void"); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if subs := b.Subscriptions(); len(subs) != 0 {
+		t.Errorf("Expected the subscription to be removed on timeout, got %d", len(subs))
+	}
+}
+
+func TestConnectCtx(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := NewBroker(ClusterID(testClusterID), broker.Addrs(addr), ClientID("configured")).(*stanBroker)
+	if err := b.ConnectCtx(context.Background(), ClientID("per-connect")); err != nil {
+		t.Fatal(err)
+	}
+	if b.clientID != "per-connect" {
+		t.Errorf("Expected the connect option to take precedence, got client id %q", b.clientID)
+	}
+	if id, _ := b.opts.Context.Value(clientIDKey{}).(string); id != "configured" {
+		t.Errorf("Expected the broker options to be unchanged, got %q", id)
+	}
+	b.Disconnect()
+
+	// nothing listens on the port, the connect loop runs until cancelled
+	b = NewBroker(ClusterID(testClusterID), broker.Addrs(fmt.Sprintf("127.0.0.1:%d", freePort(t)))).(*stanBroker)
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- b.ConnectCtx(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Expected the connect loop to be aborted, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected cancelling the context to abort the connect loop")
+	}
+}
+
+func TestRedeliveries(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	var calls int32
+	ch := make(chan struct{}, 2)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- struct{}{}
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return errors.New("failed")
+		}
+		return nil
+	}, AckOnSuccess(), SubscribeOption(stan.AckWait(time.Second))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for redelivery")
+		}
+	}
+
+	if n := b.Redeliveries("test"); n != 1 {
+		t.Errorf("Expected 1 redelivery, got %d", n)
+	}
+	if n := b.Redeliveries("other"); n != 0 {
+		t.Errorf("Expected no redeliveries of other channels, got %d", n)
+	}
+}
+
+func TestBacklogWindow(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	if err := b.Publish("test", &broker.Message{Body: []byte("old")}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if err := b.Publish("test", &broker.Message{Body: []byte("recent")}); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan string, 3)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, BacklogWindow(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("live")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"recent", "live"} {
+		if body := receive(t, ch); body != want {
+			t.Errorf("Expected %q, got %q", want, body)
+		}
+	}
+}
+
+func TestAppendHeaderToSubject(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan string, 1)
+	if _, err := b.Subscribe("orders.eu", func(e broker.Event) error {
+		ch <- e.Topic()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &broker.Message{Header: map[string]string{"Region": "eu"}, Body: []byte("order")}
+	if err := b.Publish("orders", msg, AppendHeaderToSubject("Region")); err != nil {
+		t.Fatal(err)
+	}
+	if topic := receive(t, ch); topic != "orders.eu" {
+		t.Errorf("Expected the header value appended to the subject, got %q", topic)
+	}
+
+	for _, region := range []string{"", "eu.west", "*", "eu west"} {
+		msg := &broker.Message{Header: map[string]string{"Region": region}}
+		if err := b.Publish("orders", msg, AppendHeaderToSubject("Region")); err == nil {
+			t.Errorf("Expected publishing with token %q to fail", region)
+		}
+	}
+}
+
+func TestOnConnectionLost(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	type lost struct {
+		err         error
+		intentional bool
+	}
+	ch := make(chan lost, 2)
+	b := newTestBroker(t, addr, OnConnectionLost(func(err error, intentional bool) {
+		ch <- lost{err, intentional}
+	}))
+
+	// simulate an unexpected loss
+	b.connectionLost(b.conn, errors.New("connection lost"))
+	if l := <-ch; l.intentional || l.err == nil {
+		t.Errorf("Expected an unexpected loss with its error, got %+v", l)
+	}
+
+	if err := b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if l := <-ch; !l.intentional {
+		t.Errorf("Expected Disconnect to be reported as intentional, got %+v", l)
+	}
+	// a loss reported while disconnecting is not reported again
+	b.connectionLost(nil, errors.New("connection closed"))
+	select {
+	case l := <-ch:
+		t.Errorf("Unexpected report %+v", l)
+	default:
+	}
+}
+
+func TestReconnectGrace(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	var mu sync.Mutex
+	var transitions []bool
+	readiness := Readiness(func(ready bool) {
+		mu.Lock()
+		transitions = append(transitions, ready)
+		mu.Unlock()
+	})
+
+	// a reconnect within the grace period keeps the broker ready
+	b := newTestBroker(t, addr, ConnectRetry(true), ReconnectGrace(5*time.Second), readiness)
+	b.RLock()
+	conn := b.conn
+	b.RUnlock()
+	conn.Close()
+	b.connectionLost(conn, errors.New("connection lost"))
+	if !b.Ready() {
+		t.Error("Expected broker to stay ready within the grace period")
+	}
+	b.Disconnect()
+
+	mu.Lock()
+	if fmt.Sprint(transitions) != "[true false]" {
+		t.Errorf("Expected no transitions for the blip, got %v", transitions)
+	}
+	transitions = nil
+	mu.Unlock()
+
+	// without a reconnect the broker becomes not ready once the grace period elapsed
+	b = newTestBroker(t, addr, ReconnectGrace(100*time.Millisecond), readiness)
+	defer b.Disconnect()
+	b.connectionLost(b.conn, errors.New("connection lost"))
+	if !b.Ready() {
+		t.Error("Expected broker to stay ready within the grace period")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if b.Ready() {
+		t.Error("Expected broker not to be ready after the grace period")
+	}
+}
+
+func TestNatsNoRandomize(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, NatsNoRandomize(true), ClientID("ordered"))
+	defer b.Disconnect()
+
+	opts := nats.GetDefaultOptions()
+	for _, o := range b.natsOpts {
+		if err := o(&opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !opts.NoRandomize {
+		t.Error("Expected the nats options to include DontRandomize")
+	}
+	if opts.Name != "ordered" || opts.MaxReconnect != -1 {
+		t.Errorf("Expected the stan connection defaults, got name %q and max reconnect %d", opts.Name, opts.MaxReconnect)
+	}
+	if nc := b.conn.NatsConn(); nc == nil || nc != b.nc {
+		t.Error("Expected the stan connection to use the broker's nats connection")
+	}
+}
+
+func TestPostConnect(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	var calls int32
+	b := newTestBroker(t, addr, ConnectRetry(true), PostConnect(func(conn stan.Conn) error {
+		atomic.AddInt32(&calls, 1)
+		// prime the channel
+		return conn.Publish("primed", nil)
+	}))
+	if calls != 1 {
+		t.Errorf("Expected the hook to run on connect, got %d calls", calls)
+	}
+
+	// the hook runs again on reconnect
+	b.RLock()
+	conn := b.conn
+	b.RUnlock()
+	conn.Close()
+	b.connectionLost(conn, errors.New("connection lost"))
+	if calls != 2 {
+		t.Errorf("Expected the hook to run on reconnect, got %d calls", calls)
+	}
+	b.Disconnect()
+
+	hookErr := errors.New("channel limits not met")
+	b = NewBroker(ClusterID(testClusterID), broker.Addrs(addr), PostConnect(func(stan.Conn) error {
+		return hookErr
+	})).(*stanBroker)
+	if err := b.Connect(); err != hookErr {
+		t.Errorf("Expected the hook error to fail connect, got %v", err)
+	}
+	if b.conn != nil {
+		t.Error("Expected no connection after a failed hook")
+	}
+
+	// a hook given to ConnectCtx takes precedence
+	var connectCalls int32
+	if err := b.ConnectCtx(context.Background(), PostConnect(func(stan.Conn) error {
+		atomic.AddInt32(&connectCalls, 1)
+		return nil
+	})); err != nil {
+		t.Fatalf("Expected the connect hook to replace the failing one, got %v", err)
+	}
+	defer b.Disconnect()
+	if c := atomic.LoadInt32(&connectCalls); c != 1 {
+		t.Errorf("Expected the connect hook to run, got %d calls", c)
+	}
+}
+
+func TestPostConnectReconnectRetries(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	var calls int32
+	b := newTestBroker(t, addr, ConnectRetry(true), PostConnect(func(conn stan.Conn) error {
+		// the hook fails on the first reconnect attempt
+		if atomic.AddInt32(&calls, 1) == 2 {
+			return errors.New("channel limits not met")
+		}
+		return nil
+	}))
+	defer b.Disconnect()
+
+	b.RLock()
+	conn := b.conn
+	b.RUnlock()
+	conn.Close()
+	b.connectionLost(conn, errors.New("connection lost"))
+
+	if c := atomic.LoadInt32(&calls); c != 3 {
+		t.Errorf("Expected the hook to be retried, got %d calls", c)
+	}
+	if !b.Ready() {
+		t.Error("Expected the broker to reconnect once the hook succeeded")
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, DurableName("offsets"))
+	defer b.Disconnect()
+
+	ch := make(chan uint64, 8)
+	handler := func(e broker.Event) error {
+		ch <- e.(*publication).msg.Sequence
+		return nil
+	}
+	sub, err := b.Subscribe("test", handler, broker.DisableAutoAck())
+	if err != nil {
+		t.Fatal(err)
+	}
+	offs := sub.(OffsetSubscriber)
+
+	for i := 0; i < 4; i++ {
+		if err := b.Publish("test", &broker.Message{Body: []byte("msg")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := uint64(1); i <= 4; i++ {
+		select {
+		case seq := <-ch:
+			if seq != i {
+				t.Fatalf("Expected sequence %d, got %d", i, seq)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for message")
+		}
+	}
+
+	// seeking back replays from the given sequence
+	if err := offs.Seek(2); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(2); i <= 4; i++ {
+		select {
+		case seq := <-ch:
+			if seq != i {
+				t.Fatalf("Expected sequence %d after seek, got %d", i, seq)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for message")
+		}
+	}
+
+	if err := offs.Commit(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the restarted durable resumes after the committed offset
+	if _, err := b.Subscribe("test", handler, broker.DisableAutoAck()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case seq := <-ch:
+		if seq != 4 {
+			t.Errorf("Expected to resume at sequence 4, got %d", seq)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for redelivery")
+	}
+
+	auto, err := b.Subscribe("other", handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auto.(OffsetSubscriber).Commit(1); err != errNoOffsets {
+		t.Errorf("Expected commit to require manual acks, got %v", err)
+	}
+}
+
+func TestNilCodec(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := NewBroker(ClusterID(testClusterID), broker.Addrs(addr)).(*stanBroker)
+	if err := b.Init(broker.Codec(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect()
+
+	ch := make(chan string, 1)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, ch); body != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", body)
+	}
+
+	// the payload is json encoded
+	data, err := b.codec().Marshal(&broker.Message{Body: []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "{") {
+		t.Errorf("Expected a json payload, got %q", data)
+	}
+}
+
+func TestExtractSubjectTokens(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan map[string]string, 1)
+	if _, err := b.Subscribe("events.acme.created", func(e broker.Event) error {
+		ch <- e.Message().Header
+		return nil
+	}, ExtractSubjectTokens("events.<tenant>.<type>")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("events.acme.created", &broker.Message{Body: []byte("event")}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case header := <-ch:
+		if header["tenant"] != "acme" || header["type"] != "created" {
+			t.Errorf("Expected the subject tokens in the header, got %v", header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for message")
+	}
+}
+
+func TestReplayRange(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, ReplayIdle(200*time.Millisecond))
+	defer b.Disconnect()
+
+	for i := 1; i <= 5; i++ {
+		if err := b.Publish("source", &broker.Message{Body: []byte(fmt.Sprintf("msg-%d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.ReplayRange(context.Background(), "source", "derived", 2, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var got []string
+	_, err := b.Subscribe("derived", func(e broker.Event) error {
+		mu.Lock()
+		got = append(got, string(e.Message().Body))
+		mu.Unlock()
+		return nil
+	}, SubscribeOption(stan.DeliverAllAvailable()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	if want := "msg-2,msg-3,msg-4"; strings.Join(got, ",") != want {
+		t.Errorf("Expected %s to be replayed, got %v", want, got)
+	}
+	mu.Unlock()
+
+	if err := b.ReplayRange(context.Background(), "source", "derived", 4, 2); err == nil {
+		t.Error("Expected an error for an invalid range")
+	}
+
+	// a range past the last message stops with it
+	var incomplete *ReplayIncompleteError
+	err = b.ReplayRange(context.Background(), "source", "backfill", 4, 100)
+	if !errors.As(err, &incomplete) || incomplete.Last != 5 || incomplete.End != 100 {
+		t.Errorf("Expected the replay to stop at sequence 5, got %v", err)
+	}
+
+	// a cancelled replay returns at once
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.ReplayRange(ctx, "empty", "backfill", 1, 100); err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestNilHandler(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	if _, err := b.Subscribe("test", nil); err != ErrNilHandler {
+		t.Fatalf("Expected ErrNilHandler, got %v", err)
+	}
+
+	msgs := make(chan *stan.Msg, 1)
+	_, err := b.Subscribe("test", nil, RawHandler(func(msg *stan.Msg) error {
+		msgs <- msg
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("raw")}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-msgs:
+		var m broker.Message
+		if err := b.opts.Codec.Unmarshal(msg.Data, &m); err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Body) != "raw" {
+			t.Errorf("Expected the raw message, got %q", m.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the raw handler to receive the message")
+	}
+}
+
+func TestPublishRateLimit(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, PublishRateLimit(1, 2), FailOnRateLimit(true))
+	defer b.Disconnect()
+
+	msg := &broker.Message{Body: []byte("hello")}
+	for i := 0; i < 2; i++ {
+		if err := b.Publish("test", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Publish("test", msg); err != ErrRateLimited {
+		t.Fatalf("Expected ErrRateLimited after the burst, got %v", err)
+	}
+}
+
+// dotNamer lowercases topics and separates their words with dots
+type dotNamer struct{}
+
+func (dotNamer) Name(topic string) string {
+	return strings.NewReplacer("-", ".", "_", ".").Replace(strings.ToLower(topic))
+}
+
+func TestSubjectNaming(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, SubjectNaming(dotNamer{}))
+	defer b.Disconnect()
+
+	ch := make(chan string, 1)
+	sub, err := b.Subscribe("Order-Created", func(e broker.Event) error {
+		ch <- e.Topic()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topic := sub.Topic(); topic != "order.created" {
+		t.Errorf("Expected the subscription on order.created, got %s", topic)
+	}
+
+	if err := b.Publish("order_created", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if topic := receive(t, ch); topic != "order.created" {
+		t.Errorf("Expected the message on order.created, got %s", topic)
+	}
+}
+
+func TestDelivered(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	var wg sync.WaitGroup
+	wg.Add(5)
+	sub, err := b.Subscribe("test", func(e broker.Event) error {
+		wg.Done()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	if n := sub.(interface{ Delivered() uint64 }).Delivered(); n != 5 {
+		t.Errorf("Expected 5 delivered messages, got %d", n)
+	}
+}
+
+func TestLastSequence(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan string, 3)
+	sub, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := sub.(interface{ LastSequence() uint64 })
+	if last := seq.LastSequence(); last != 0 {
+		t.Errorf("Expected no last sequence before a delivery, got %d", last)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, ch)
+		if last := seq.LastSequence(); last != uint64(i+1) {
+			t.Errorf("Expected last sequence %d, got %d", i+1, last)
+		}
+	}
+}
+
+func TestProxyDialer(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	var dialed int32
+	b := newTestBroker(t, addr, ProxyDialer(func(network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		return net.Dial(network, addr)
+	}))
+	defer b.Disconnect()
+
+	if atomic.LoadInt32(&dialed) == 0 {
+		t.Error("Expected the proxy dialer to be used")
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateSubscription(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	ch := make(chan string, 10)
+	sub, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, SubscribeOptions().Durable("durable").MaxInflight(10).Build())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish := func(bodies ...string) {
+		for _, body := range bodies {
+			if err := b.Publish("test", &broker.Message{Body: []byte(body)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	publish("1", "2")
+	for _, want := range []string{"1", "2"} {
+		if got := receive(t, ch); got != want {
+			t.Fatalf("Expected message %s, got %s", want, got)
+		}
+	}
+
+	if err := b.UpdateSubscription(sub, SubscribeOption(stan.MaxInflight(1))); err != nil {
+		t.Fatal(err)
+	}
+	bopts := stan.DefaultSubscriptionOptions
+	for _, o := range sub.(*subscriber).sopts {
+		o(&bopts)
+	}
+	if bopts.MaxInflight != 1 || bopts.DurableName != "durable" {
+		t.Errorf("Expected the durable with MaxInflight 1, got %q with %d", bopts.DurableName, bopts.MaxInflight)
+	}
+
+	// the durable resumes after the last message instead of replaying
+	publish("3", "4")
+	for _, want := range []string{"3", "4"} {
+		if got := receive(t, ch); got != want {
+			t.Fatalf("Expected message %s, got %s", want, got)
+		}
+	}
+
+	plain, err := b.Subscribe("plain", func(broker.Event) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.UpdateSubscription(plain, SubscribeOption(stan.MaxInflight(1))); err == nil {
+		t.Error("Expected updating a non durable subscription to fail")
+	}
+}
+
+func TestEffectiveStanOptions(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	sopts := stan.GetDefaultOptions()
+	sopts.AckTimeout = 3 * time.Second
+	sopts.MaxPubAcksInflight = 64
+	sopts.PingInterval = 2
+	sopts.PingMaxOut = 4
+	b := newTestBroker(t, addr, Options(sopts), ConnectWait(5*time.Second))
+	defer b.Disconnect()
+
+	opts := b.EffectiveStanOptions()
+	if opts.AckTimeout != 3*time.Second || opts.MaxPubAcksInflight != 64 {
+		t.Errorf("Expected the publish options, got ack wait %v and %d in flight", opts.AckTimeout, opts.MaxPubAcksInflight)
+	}
+	if opts.PingInterval != 2 || opts.PingMaxOut != 4 {
+		t.Errorf("Expected the ping options, got %d and %d", opts.PingInterval, opts.PingMaxOut)
+	}
+	if opts.ConnectTimeout != 5*time.Second {
+		t.Errorf("Expected ConnectWait to apply, got %v", opts.ConnectTimeout)
+	}
+	if opts.NatsURL != "nats://"+addr || opts.NatsConn != b.nc {
+		t.Errorf("Expected the broker address and connection, got %s", opts.NatsURL)
+	}
+	if opts.ConnectionLostCB == nil {
+		t.Error("Expected the connection lost handler to be set")
+	}
+}
+
+func TestInitWhileConnected(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := b.Init(broker.Addrs("127.0.0.1:1")); err == nil {
+				t.Error("Expected Init to fail while connected")
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	if b.Address() != "nats://"+addr {
+		t.Errorf("Expected the addresses to be unchanged, got %s", b.Address())
+	}
+	if err := b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Init(broker.Addrs("127.0.0.1:1")); err != nil {
+		t.Errorf("Expected Init to apply once disconnected, got %v", err)
+	}
+}
+
+func TestInitWhileDisconnected(t *testing.T) {
+	b := NewBroker(ClusterID(testClusterID)).(*stanBroker)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := b.Publish("", &broker.Message{Body: []byte("hello")}); err == nil {
+				t.Error("Expected Publish to fail while disconnected")
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if _, err := b.Subscribe("test", func(broker.Event) error { return nil }); err == nil {
+				t.Error("Expected Subscribe to fail while disconnected")
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := b.Init(DefaultTopic("test")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestAtMostOnce(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	durable := SubscribeOptions().Durable("durable").Build()
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+	started := make(chan struct{}, 1)
+	sub, err := b.Subscribe("test", func(e broker.Event) error {
+		started <- struct{}{}
+		// simulates a crashed handler
+		<-stuck
+		return nil
+	}, durable, AtMostOnce(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("test", &broker.Message{Body: []byte("first")}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan string, 2)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, durable); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("second")}); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, ch); body != "second" {
+		t.Errorf("Expected the crashed message not to be redelivered, got %q", body)
+	}
+}
+
+func TestKeepaliveOptions(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, FlushTimeout(3*time.Second), NatsPingInterval(20*time.Second))
+	defer b.Disconnect()
+
+	opts := nats.GetDefaultOptions()
+	for _, o := range b.natsOpts {
+		if err := o(&opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if opts.FlusherTimeout != 3*time.Second {
+		t.Errorf("Expected a flusher timeout of 3s, got %v", opts.FlusherTimeout)
+	}
+	if opts.PingInterval != 20*time.Second {
+		t.Errorf("Expected a ping interval of 20s, got %v", opts.PingInterval)
+	}
+	if b.nc.Opts.PingInterval != 20*time.Second {
+		t.Errorf("Expected the connection to use the ping interval, got %v", b.nc.Opts.PingInterval)
+	}
+}
+
+func TestDecodeFunc(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	// v1 payloads are codec encoded, v2 ones are plain text
+	decode := DecodeFunc(func(subject string, data []byte) (*broker.Message, error) {
+		if strings.HasSuffix(subject, ".v2") {
+			return &broker.Message{Header: map[string]string{"schema": "v2"}, Body: data}, nil
+		}
+		m := &broker.Message{}
+		if err := b.opts.Codec.Unmarshal(data, m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	})
+
+	ch := make(chan *broker.Message, 2)
+	for _, topic := range []string{"orders.v1", "orders.v2"} {
+		if _, err := b.Subscribe(topic, func(e broker.Event) error {
+			ch <- e.Message()
+			return nil
+		}, decode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Publish("orders.v1", &broker.Message{Header: map[string]string{"schema": "v1"}, Body: []byte("encoded")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.conn.Publish("orders.v2", []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-ch:
+			got[m.Header["schema"]] = string(m.Body)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for message")
+		}
+	}
+	if got["v1"] != "encoded" || got["v2"] != "plain" {
+		t.Errorf("Expected each channel decoded by its schema, got %v", got)
+	}
+}
+
+func TestMaxConnectDuration(t *testing.T) {
+	// a plain nats server never answers the streaming connect request
+	nopts := natsd.Options{Host: "127.0.0.1", Port: freePort(t), NoLog: true, NoSigs: true}
+	ns, err := natsd.NewServer(&nopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	defer ns.Shutdown()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+
+	b := NewBroker(
+		ClusterID(testClusterID),
+		broker.Addrs(fmt.Sprintf("127.0.0.1:%d", nopts.Port)),
+		ConnectWait(10*time.Second),
+		MaxConnectDuration(500*time.Millisecond),
+	)
+	start := time.Now()
+	if err := b.Connect(); err == nil {
+		b.Disconnect()
+		t.Fatal("Expected connect to fail")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Expected connect to abort at the ceiling, took %v", d)
+	}
+}
+
+func TestReliability(t *testing.T) {
+	// the streaming server runs on a separate nats server so it can be stopped
+	// while the broker stays connected to nats
+	nopts := natsd.Options{Host: "127.0.0.1", Port: freePort(t), NoLog: true, NoSigs: true}
+	ns, err := natsd.NewServer(&nopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	defer ns.Shutdown()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", nopts.Port)
+
+	sopts := stand.GetDefaultOptions()
+	sopts.ID = testClusterID
+	sopts.NATSServerURL = "nats://" + addr
+	ss, err := stand.RunServerWithOpts(sopts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copts := stan.GetDefaultOptions()
+	copts.AckTimeout = 500 * time.Millisecond
+	b := newTestBroker(t, addr, Options(copts))
+	defer b.Disconnect()
+
+	msg := &broker.Message{Body: []byte("hello")}
+	if err := b.Publish("test", msg, Reliability(PublishAtMostOnce)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", msg, Reliability(PublishAtLeastOnce)); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a streaming server no acks arrive
+	ss.Shutdown()
+
+	start := time.Now()
+	if err := b.Publish("test", msg, Reliability(PublishAtMostOnce)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Expected an at most once publish not to wait for the ack, took %v", d)
+	}
+
+	start = time.Now()
+	if err := b.Publish("test", msg); err == nil {
+		t.Error("Expected an at least once publish to fail without an ack")
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("Expected an at least once publish to wait for the ack, took %v", d)
+	}
+}
+
+func TestPromoteToDurable(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, ClientID("promote"))
+	defer b.Disconnect()
+
+	ch := make(chan string, 10)
+	handler := func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}
+	sub, err := b.Subscribe("test", handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish := func(bodies ...string) {
+		for _, body := range bodies {
+			if err := b.Publish("test", &broker.Message{Body: []byte(body)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expect := func(bodies ...string) {
+		for _, want := range bodies {
+			if got := receive(t, ch); got != want {
+				t.Fatalf("Expected message %s, got %s", want, got)
+			}
+		}
+	}
+
+	publish("1", "2")
+	expect("1", "2")
+
+	if err := b.PromoteToDurable(sub, "promoted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PromoteToDurable(sub, "promoted"); err == nil {
+		t.Error("Expected promoting a durable to fail")
+	}
+	publish("3")
+	expect("3")
+
+	// closing keeps the durable, it resumes after the last message
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	publish("4")
+	if _, err := b.Subscribe("test", handler, SubscribeOptions().Durable("promoted").Build()); err != nil {
+		t.Fatal(err)
+	}
+	expect("4")
+
+	select {
+	case body := <-ch:
+		t.Errorf("Expected no duplicate messages, got %s", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestStateChanges(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := NewBroker(ClusterID(testClusterID), broker.Addrs(addr)).(*stanBroker)
+	ch := b.StateChanges()
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	var states []string
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case s, ok := <-ch:
+			if !ok {
+				done = true
+				break
+			}
+			states = append(states, s.String())
+		case <-timeout:
+			t.Fatal("Expected the channel to be closed on Disconnect")
+		}
+	}
+	if got := strings.Join(states, ","); got != "connected,disconnected" {
+		t.Errorf("Expected connected,disconnected, got %s", got)
+	}
+}
+
+func TestNatsOptions(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	var handled int32
+	b := newTestBroker(t, addr, ClientID("default"), NatsOptions(
+		nats.Name("custom"),
+		nats.ErrorHandler(func(*nats.Conn, *nats.Subscription, error) {
+			atomic.AddInt32(&handled, 1)
+		}),
+	))
+	defer b.Disconnect()
+
+	opts := nats.GetDefaultOptions()
+	for _, o := range b.natsOpts {
+		if err := o(&opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if opts.Name != "custom" {
+		t.Errorf("Expected the injected name to override the default, got %q", opts.Name)
+	}
+	if opts.AsyncErrorCB == nil || b.nc.Opts.AsyncErrorCB == nil {
+		t.Error("Expected the injected error handler to be set")
+	}
+}
+
+func TestDefaultTopic(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, DefaultTopic("events"))
+	defer b.Disconnect()
+
+	ch := make(chan string, 1)
+	if _, err := b.Subscribe("events", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, ch); body != "hello" {
+		t.Errorf("Expected the message on the default topic, got %q", body)
+	}
+
+	plain := newTestBroker(t, addr)
+	defer plain.Disconnect()
+	if err := plain.Publish("", &broker.Message{Body: []byte("hello")}); err == nil {
+		t.Error("Expected an empty topic to fail without DefaultTopic")
+	}
+}
+
+func TestReconnectRedeliversInflight(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, ConnectRetry(true))
+	defer b.Disconnect()
+
+	events := make(chan broker.Event, 2)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		events <- e
+		return nil
+	}, SubscribeOptions().Durable("durable").AckWait(time.Second).Build(), broker.DisableAutoAck()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("inflight")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var inflight broker.Event
+	select {
+	case inflight = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for message")
+	}
+
+	// simulate a lost connection, the broker reconnects and resubscribes
+	b.RLock()
+	conn := b.conn
+	b.RUnlock()
+	conn.Close()
+	b.connectionLost(conn, errors.New("connection lost"))
+
+	if err := inflight.Ack(); err != ErrStaleAck {
+		t.Errorf("Expected the in-flight message not to be acked, got %v", err)
+	}
+
+	select {
+	case e := <-events:
+		if string(e.Message().Body) != "inflight" {
+			t.Errorf("Expected the in-flight message to be redelivered, got %q", e.Message().Body)
+		}
+		if err := e.Ack(); err != nil {
+			t.Errorf("Expected the redelivered message to be acked, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the in-flight message to be redelivered")
+	}
+}
+
+func TestReconnectRedeliversUnacked(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, ConnectRetry(true))
+	defer b.Disconnect()
+
+	events := make(chan broker.Event, 4)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		events <- e
+		return nil
+	}, broker.DisableAutoAck()); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"acked", "unacked", "after"} {
+		if err := b.Publish("test", &broker.Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ack all but the second message
+	for i := 0; i < 3; i++ {
+		select {
+		case e := <-events:
+			if string(e.Message().Body) != "unacked" {
+				if err := e.Ack(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for message")
+		}
+	}
+
+	b.RLock()
+	conn := b.conn
+	b.RUnlock()
+	conn.Close()
+	b.connectionLost(conn, errors.New("connection lost"))
+
+	select {
+	case e := <-events:
+		if string(e.Message().Body) != "unacked" {
+			t.Errorf("Expected the unacked message to be redelivered first, got %q", e.Message().Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the unacked message to be redelivered")
+	}
+}
+
+func TestReconnectResumesAfterReceived(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, ConnectRetry(true))
+	defer b.Disconnect()
+
+	for _, body := range []string{"first", "second"} {
+		if err := b.Publish("test", &broker.Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ch := make(chan string, 10)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, SubscribeOptions().DeliverAllAvailable().Build()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"first", "second"} {
+		if got := receive(t, ch); got != want {
+			t.Fatalf("Expected %q, got %q", want, got)
+		}
+	}
+
+	b.RLock()
+	conn := b.conn
+	b.RUnlock()
+	conn.Close()
+	b.connectionLost(conn, errors.New("connection lost"))
+
+	if err := b.Publish("test", &broker.Message{Body: []byte("third")}); err != nil {
+		t.Fatal(err)
+	}
+	// the channel isn't replayed from the start position
+	if got := receive(t, ch); got != "third" {
+		t.Errorf("Expected the subscription to resume at %q, got %q", "third", got)
+	}
+}
+
+func TestDisconnectReleasesSubscriptions(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan string, 1)
+	sub, err := b.Subscribe("batched", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return e.Ack()
+	}, broker.DisableAutoAck(), AckBatch(time.Hour, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("batched", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, ch)
+
+	if err := b.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if l := len(b.Subscriptions()); l != 0 {
+		t.Errorf("Expected no subscriptions after disconnect, got %d", l)
+	}
+
+	// the batcher sent the pending ack and stopped
+	batch := sub.(*subscriber).batch
+	select {
+	case <-batch.done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the ack batcher to be stopped")
+	}
+	batch.mu.Lock()
+	pending := len(batch.pending)
+	batch.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("Expected the pending acks to be sent, got %d pending", pending)
+	}
+}
+
+func TestEmptyPayloads(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	for _, allow := range []bool{false, true} {
+		topic := fmt.Sprintf("empty.%t", allow)
+		ch := make(chan string, 2)
+		if _, err := b.Subscribe(topic, func(e broker.Event) error {
+			ch <- string(e.Message().Body)
+			return e.Ack()
+		}, broker.DisableAutoAck(), AllowEmptyPayloads(allow)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.conn.Publish(topic, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Publish(topic, &broker.Message{Body: []byte("hello")}); err != nil {
+			t.Fatal(err)
+		}
+
+		if allow {
+			if body := receive(t, ch); body != "" {
+				t.Errorf("Expected the empty payload as an empty message, got %q", body)
+			}
+		}
+		if body := receive(t, ch); body != "hello" {
+			t.Errorf("Expected %q with AllowEmptyPayloads(%t), got %q", "hello", allow, body)
+		}
+	}
+}
+
+func TestClusterAndClientID(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := NewBroker(ClusterID(testClusterID), broker.Addrs(addr)).(*stanBroker)
+	if b.ClusterID() != "" || b.ClientID() != "" {
+		t.Errorf("Expected no ids before Connect, got %q and %q", b.ClusterID(), b.ClientID())
+	}
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect()
+	if b.ClusterID() != testClusterID {
+		t.Errorf("Expected cluster id %q, got %q", testClusterID, b.ClusterID())
+	}
+	if len(b.ClientID()) == 0 {
+		t.Error("Expected a generated client id")
+	}
+
+	nb := newTestBroker(t, addr, ClientID("client"))
+	defer nb.Disconnect()
+	if nb.ClientID() != "client" {
+		t.Errorf("Expected client id %q, got %q", "client", nb.ClientID())
+	}
+}
+
+func TestCodecCheck(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	mismatches := make(chan error, 2)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		return nil
+	}, CodecCheck(true), OnCodecMismatch(func(topic string, err error) {
+		mismatches <- err
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	// a producer sending raw bytes instead of json envelopes
+	for i := 0; i < 2; i++ {
+		if err := b.conn.Publish("test", []byte("raw")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case err := <-mismatches:
+		if err == nil {
+			t.Error("Expected the decode error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a codec mismatch warning")
+	}
+	select {
+	case <-mismatches:
+		t.Error("Expected only the first message to be checked")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMaxReceiveSize(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	errs := make(chan error, 1)
+	ch := make(chan string, 2)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, MaxReceiveSize(1024), SubscribeErrorHandler(func(e broker.Event) error {
+		errs <- e.Error()
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.conn.Publish("test", bytes.Repeat([]byte("x"), 4096)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("small")}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != ErrMessageTooLarge {
+			t.Errorf("Expected %v, got %v", ErrMessageTooLarge, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the oversized message in the error handler")
+	}
+	if body := receive(t, ch); body != "small" {
+		t.Errorf("Expected only the small message to reach the handler, got %q", body)
+	}
+}
@@ -0,0 +1,106 @@
+package stan
+
+import (
+	"context"
+	"sync"
+)
+
+// ConnState is a connection state reported by StateChanges
+type ConnState int
+
+const (
+	// Connected is reported once a connect succeeded
+	Connected ConnState = iota
+	// Disconnected is reported when the connection is lost or closed
+	Disconnected
+	// Reconnecting is reported when ConnectRetry starts reconnecting
+	Reconnecting
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	case Reconnecting:
+		return "reconnecting"
+	}
+	return "unknown"
+}
+
+// stateListeners holds the channels returned by StateChanges and the signal of
+// WaitReconnect
+type stateListeners struct {
+	sync.Mutex
+	chs []chan ConnState
+	// closed once the next reconnect completed
+	reconnected chan struct{}
+}
+
+func (l *stateListeners) add() chan ConnState {
+	ch := make(chan ConnState, 8)
+	l.Lock()
+	l.chs = append(l.chs, ch)
+	l.Unlock()
+	return ch
+}
+
+// emit sends s to every listener, a listener that fell behind misses it
+func (l *stateListeners) emit(s ConnState) {
+	l.Lock()
+	defer l.Unlock()
+	for _, ch := range l.chs {
+		select {
+		case ch <- s:
+		default:
+		}
+	}
+}
+
+// next returns the signal of the next reconnect
+func (l *stateListeners) next() <-chan struct{} {
+	l.Lock()
+	defer l.Unlock()
+	if l.reconnected == nil {
+		l.reconnected = make(chan struct{})
+	}
+	return l.reconnected
+}
+
+// reconnect signals the waiters of the completed reconnect
+func (l *stateListeners) reconnect() {
+	l.Lock()
+	defer l.Unlock()
+	if l.reconnected != nil {
+		close(l.reconnected)
+		l.reconnected = nil
+	}
+}
+
+func (l *stateListeners) close() {
+	l.Lock()
+	defer l.Unlock()
+	for _, ch := range l.chs {
+		close(ch)
+	}
+	l.chs = nil
+}
+
+// StateChanges returns a channel receiving the connection state changes of the
+// broker. It is closed by Disconnect, after the final Disconnected state. The
+// channel is buffered, states are dropped while the buffer is full.
+func (n *stanBroker) StateChanges() <-chan ConnState {
+	return n.states.add()
+}
+
+// WaitReconnect blocks until the next reconnect after a lost connection or a
+// RotateCredentials completed, including the resubscriptions, or ctx is done
+func (n *stanBroker) WaitReconnect(ctx context.Context) error {
+	select {
+	case <-n.states.next():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,53 @@
+package stan
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// stats counts message events per channel
+type stats struct {
+	sync.Mutex
+	redeliveries map[string]uint64
+}
+
+func newStats() *stats {
+	return &stats{redeliveries: make(map[string]uint64)}
+}
+
+func (s *stats) redelivered(channel string) {
+	s.Lock()
+	s.redeliveries[channel]++
+	s.Unlock()
+}
+
+// Redeliveries returns the number of redelivered messages received on channel
+func (n *stanBroker) Redeliveries(channel string) uint64 {
+	n.stats.Lock()
+	defer n.stats.Unlock()
+	return n.stats.redeliveries[channel]
+}
+
+// Delivered returns the number of messages passed to the handler since the
+// subscription started, redeliveries included
+func (n *subscriber) Delivered() uint64 {
+	return atomic.LoadUint64(&n.delivered)
+}
+
+// Pending returns the number of messages received from the server that wait for
+// the handler
+func (n *subscriber) Pending() (int, error) {
+	s := n.sub()
+	if s == nil {
+		return 0, errors.New("[stan]: not subscribed")
+	}
+	msgs, _, err := s.Pending()
+	return msgs, err
+}
+
+// LastSequence returns the channel sequence of the message most recently passed to
+// the handler, zero before the first one
+func (n *subscriber) LastSequence() uint64 {
+	return atomic.LoadUint64(&n.last)
+}
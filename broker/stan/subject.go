@@ -0,0 +1,58 @@
+package stan
+
+import (
+	"context"
+	"strings"
+)
+
+// SubjectNamer maps broker topics to the subjects they are published and subscribed
+// on, e.g. to apply a team's naming convention in one place
+type SubjectNamer interface {
+	Name(topic string) string
+}
+
+// subjectName returns the subject of topic using the SubjectNaming of the broker
+// context, topics are used as is without one
+func subjectName(ctx context.Context, topic string) string {
+	if ctx == nil {
+		return topic
+	}
+	if namer, ok := ctx.Value(subjectNamerKey{}).(SubjectNamer); ok && namer != nil {
+		return namer.Name(topic)
+	}
+	return topic
+}
+
+// subjectPattern maps the tokens of a subject to headers, a token written as <name>
+// is stored in the header name and literal tokens must match
+type subjectPattern []string
+
+func parseSubjectPattern(pattern string) subjectPattern {
+	return subjectPattern(strings.Split(pattern, "."))
+}
+
+// extract adds the named tokens of subject to header, nothing is added if the
+// subject doesn't match the pattern
+func (p subjectPattern) extract(subject string, header map[string]string) map[string]string {
+	tokens := strings.Split(subject, ".")
+	if len(tokens) != len(p) {
+		return header
+	}
+	values := make(map[string]string)
+	for i, t := range p {
+		if len(t) > 2 && strings.HasPrefix(t, "<") && strings.HasSuffix(t, ">") {
+			values[t[1:len(t)-1]] = tokens[i]
+			continue
+		}
+		if t != tokens[i] {
+			return header
+		}
+	}
+	if header == nil {
+		header = make(map[string]string, len(values))
+	}
+	for k, v := range values {
+		header[k] = v
+	}
+	return header
+}
@@ -0,0 +1,29 @@
+package stan
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSubjectPattern(t *testing.T) {
+	p := parseSubjectPattern("events.<tenant>.<type>")
+	testCases := []struct {
+		subject string
+		header  string
+	}{
+		{"events.acme.created", "map[Id:1 tenant:acme type:created]"},
+		{"events.acme", "map[Id:1]"},
+		{"orders.acme.created", "map[Id:1]"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.subject, func(t *testing.T) {
+			header := p.extract(tc.subject, map[string]string{"Id": "1"})
+			if got := fmt.Sprint(header); got != tc.header {
+				t.Errorf("Expected header %s, got %s", tc.header, got)
+			}
+		})
+	}
+	if header := p.extract("events.acme.created", nil); header["tenant"] != "acme" {
+		t.Errorf("Expected a header to be created, got %v", header)
+	}
+}
@@ -0,0 +1,43 @@
+package stan
+
+import (
+	"encoding/json"
+
+	"github.com/micro/go-micro/v2/broker"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+// ErrorRecord is published as JSON to the SystemErrorTopic when a handler fails or a
+// message can't be decoded
+type ErrorRecord struct {
+	Topic    string `json:"topic"`
+	Sequence uint64 `json:"sequence"`
+	Error    string `json:"error"`
+}
+
+// reportError publishes the error of p to the SystemErrorTopic if one is set. Errors
+// of the system topic itself aren't reported and a failed report is only logged,
+// so reporting can't loop.
+func (n *stanBroker) reportError(p *publication) {
+	topic, _ := n.opts.Context.Value(systemErrorTopicKey{}).(string)
+	if len(topic) == 0 || p.err == nil || p.t == subjectName(n.opts.Context, topic) {
+		return
+	}
+
+	rec := ErrorRecord{Topic: p.t, Error: p.err.Error()}
+	if p.msg != nil {
+		rec.Sequence = p.msg.Sequence
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		n.logf(log.ErrorLevel, "[stan]: failed to encode error record of %s: %v", p.t, err)
+		return
+	}
+	msg := &broker.Message{
+		Header: map[string]string{"Content-Type": "application/json"},
+		Body:   b,
+	}
+	if err := n.Publish(topic, msg); err != nil {
+		n.logf(log.ErrorLevel, "[stan]: failed to publish error record of %s: %v", p.t, err)
+	}
+}
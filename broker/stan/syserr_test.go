@@ -0,0 +1,55 @@
+package stan
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestSystemErrorTopic(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, SystemErrorTopic("system.errors"))
+	defer b.Disconnect()
+
+	records := make(chan ErrorRecord, 2)
+	if _, err := b.Subscribe("system.errors", func(e broker.Event) error {
+		var rec ErrorRecord
+		if err := json.Unmarshal(e.Message().Body, &rec); err != nil {
+			t.Error(err)
+		}
+		records <- rec
+		// a failing system topic handler must not be reported again
+		return errors.New("system handler failed")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		return errors.New("handler failed")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("test", &broker.Message{Body: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case rec := <-records:
+		if rec.Topic != "test" || rec.Sequence != 1 || rec.Error != "handler failed" {
+			t.Errorf("Unexpected error record %+v", rec)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected an error record on the system topic")
+	}
+
+	select {
+	case rec := <-records:
+		t.Errorf("Expected no record for the system topic, got %+v", rec)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,80 @@
+package stan
+
+import (
+	"context"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+// Span is a tracing span started by a Tracer
+type Span interface {
+	RecordError(err error)
+	End()
+}
+
+// Tracer starts spans around publish and receive and propagates their context
+// through the message header. It mirrors the OpenTelemetry tracer and text map
+// propagator, so an adapter only has to forward the calls.
+type Tracer interface {
+	// Start starts a span as a child of the span in ctx
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Inject writes the span context of ctx into the header
+	Inject(ctx context.Context, header map[string]string)
+	// Extract returns a context carrying the span context found in the header
+	Extract(ctx context.Context, header map[string]string) context.Context
+}
+
+// EventContext returns the context of a received event, it carries the receive
+// span when tracing is enabled
+func EventContext(e broker.Event) context.Context {
+	if p, ok := e.(*publication); ok && p.ctx != nil {
+		return p.ctx
+	}
+	return context.Background()
+}
+
+// tracePublish wraps publish in a span and injects its context into the message header
+func tracePublish(tracer Tracer) PublishWrapper {
+	return func(next PublishFunc) PublishFunc {
+		return func(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+			options := broker.PublishOptions{Context: context.Background()}
+			for _, o := range opts {
+				o(&options)
+			}
+
+			ctx, span := tracer.Start(options.Context, "stan.publish "+topic)
+			defer span.End()
+
+			// copy the message so the caller's header isn't modified
+			header := make(map[string]string, len(msg.Header))
+			for k, v := range msg.Header {
+				header[k] = v
+			}
+			tracer.Inject(ctx, header)
+
+			err := next(topic, &broker.Message{Header: header, Body: msg.Body}, opts...)
+			if err != nil {
+				span.RecordError(err)
+			}
+			return err
+		}
+	}
+}
+
+// traceHandler continues the trace from the message header around the handler
+func traceHandler(tracer Tracer, h broker.Handler) broker.Handler {
+	return func(e broker.Event) error {
+		ctx := tracer.Extract(EventContext(e), e.Message().Header)
+		ctx, span := tracer.Start(ctx, "stan.receive "+e.Topic())
+		defer span.End()
+
+		if p, ok := e.(*publication); ok {
+			p.ctx = ctx
+		}
+		err := h(e)
+		if err != nil {
+			span.RecordError(err)
+		}
+		return err
+	}
+}
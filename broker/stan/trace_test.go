@@ -0,0 +1,95 @@
+package stan
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+type fakeSpan struct {
+	id     string
+	parent string
+	name   string
+}
+
+func (s *fakeSpan) RecordError(err error) {}
+
+func (s *fakeSpan) End() {}
+
+type spanKey struct{}
+
+type fakeTracer struct {
+	sync.Mutex
+	spans []*fakeSpan
+}
+
+func (f *fakeTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	f.Lock()
+	defer f.Unlock()
+	span := &fakeSpan{id: fmt.Sprint(len(f.spans) + 1), name: name}
+	if parent, ok := ctx.Value(spanKey{}).(string); ok {
+		span.parent = parent
+	}
+	f.spans = append(f.spans, span)
+	return context.WithValue(ctx, spanKey{}, span.id), span
+}
+
+func (f *fakeTracer) Inject(ctx context.Context, header map[string]string) {
+	if id, ok := ctx.Value(spanKey{}).(string); ok {
+		header["X-Span-Id"] = id
+	}
+}
+
+func (f *fakeTracer) Extract(ctx context.Context, header map[string]string) context.Context {
+	if id, ok := header["X-Span-Id"]; ok {
+		return context.WithValue(ctx, spanKey{}, id)
+	}
+	return ctx
+}
+
+func TestTracing(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	tracer := &fakeTracer{}
+	b := newTestBroker(t, addr, Tracing(tracer))
+	defer b.Disconnect()
+
+	ch := make(chan string, 1)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		id, _ := EventContext(e).Value(spanKey{}).(string)
+		ch <- id
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &broker.Message{Body: []byte("traced")}
+	if err := b.Publish("test", msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.Header["X-Span-Id"]; ok {
+		t.Error("Expected caller's message not to be modified")
+	}
+
+	id := receive(t, ch)
+
+	tracer.Lock()
+	defer tracer.Unlock()
+	if len(tracer.spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(tracer.spans))
+	}
+	pub, rcv := tracer.spans[0], tracer.spans[1]
+	if pub.name != "stan.publish test" || rcv.name != "stan.receive test" {
+		t.Errorf("Unexpected span names %q and %q", pub.name, rcv.name)
+	}
+	if rcv.parent != pub.id {
+		t.Errorf("Expected receive span to be a child of %s, got parent %q", pub.id, rcv.parent)
+	}
+	if id != rcv.id {
+		t.Errorf("Expected handler context to carry receive span %s, got %q", rcv.id, id)
+	}
+}
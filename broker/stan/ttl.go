@@ -0,0 +1,21 @@
+package stan
+
+import "time"
+
+// ExpiresHeader carries the RFC 3339 time after which a message is stale, it is
+// honoured by subscribers using RespectTTL
+const ExpiresHeader = "Micro-Expires"
+
+// expired reports whether the expiry carried by header has passed, a missing or
+// invalid expiry never expires
+func expired(header map[string]string, now time.Time) bool {
+	v, ok := header[ExpiresHeader]
+	if !ok {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return false
+	}
+	return !now.Before(t)
+}
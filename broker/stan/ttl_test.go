@@ -0,0 +1,27 @@
+package stan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		name    string
+		header  map[string]string
+		expired bool
+	}{
+		{"none", nil, false},
+		{"past", map[string]string{ExpiresHeader: now.Add(-time.Second).Format(time.RFC3339Nano)}, true},
+		{"future", map[string]string{ExpiresHeader: now.Add(time.Minute).Format(time.RFC3339)}, false},
+		{"invalid", map[string]string{ExpiresHeader: "tomorrow"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := expired(tc.header, now); got != tc.expired {
+				t.Errorf("Expected expired %v, got %v", tc.expired, got)
+			}
+		})
+	}
+}
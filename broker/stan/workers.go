@@ -0,0 +1,38 @@
+package stan
+
+// workerPool runs deliveries on a fixed number of goroutines
+type workerPool struct {
+	queue chan *publication
+	quit  <-chan struct{}
+}
+
+func newWorkerPool(n int, quit <-chan struct{}, deliver func(*publication)) *workerPool {
+	wp := &workerPool{
+		queue: make(chan *publication),
+		quit:  quit,
+	}
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				select {
+				case p := <-wp.queue:
+					deliver(p)
+				case <-quit:
+					return
+				}
+			}
+		}()
+	}
+	return wp
+}
+
+// dispatch blocks until a worker picks up the publication or the pool is stopped,
+// it reports whether a worker took it
+func (wp *workerPool) dispatch(p *publication) bool {
+	select {
+	case wp.queue <- p:
+		return true
+	case <-wp.quit:
+		return false
+	}
+}
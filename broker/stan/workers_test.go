@@ -0,0 +1,232 @@
+package stan
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/v2/broker"
+)
+
+func TestWorkersConcurrency(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	var mu sync.Mutex
+	var running, max int
+	var wg sync.WaitGroup
+	wg.Add(6)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		defer wg.Done()
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}, Workers(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 6; i++ {
+		if err := b.Publish("test", &broker.Message{Body: []byte("work")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	if max != 3 {
+		t.Errorf("Expected 3 concurrent handlers, got %d", max)
+	}
+}
+
+func TestQueueWorkers(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, DefaultSubscribeOptions(Workers(6)))
+	defer b.Disconnect()
+
+	var mu sync.Mutex
+	var running, max int
+	var wg sync.WaitGroup
+	wg.Add(6)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		defer wg.Done()
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}, broker.Queue("queue"), QueueWorkers(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 6; i++ {
+		if err := b.Publish("test", &broker.Message{Body: []byte("work")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	if max != 2 {
+		t.Errorf("Expected 2 concurrent handlers for the queue member, got %d", max)
+	}
+}
+
+// testWorkerAckMode subscribes a durable whose handler never completes, closes it
+// and resumes the durable, returning the first message body it receives
+func testWorkerAckMode(t *testing.T, mode AckMode) string {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	durable := SubscribeOptions().Durable("durable").Build()
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+	started := make(chan struct{}, 1)
+	sub, err := b.Subscribe("test", func(e broker.Event) error {
+		started <- struct{}{}
+		// simulates a crashed handler
+		<-stuck
+		return nil
+	}, durable, Workers(1), WorkerAckMode(mode))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("test", &broker.Message{Body: []byte("first")}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan string, 2)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, durable); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("test", &broker.Message{Body: []byte("second")}); err != nil {
+		t.Fatal(err)
+	}
+	return receive(t, ch)
+}
+
+func TestWorkerAckOnComplete(t *testing.T) {
+	if body := testWorkerAckMode(t, OnComplete); body != "first" {
+		t.Errorf("Expected unfinished message to be redelivered, got %q", body)
+	}
+}
+
+func TestWorkerAckOnDispatch(t *testing.T) {
+	if body := testWorkerAckMode(t, OnDispatch); body != "second" {
+		t.Errorf("Expected dispatched message not to be redelivered, got %q", body)
+	}
+}
+
+func TestShutdownRedeliversBuffered(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr, ClientID("buffered"))
+	durable := SubscribeOptions().Durable("durable").Build()
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+	started := make(chan struct{}, 1)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		started <- struct{}{}
+		<-stuck
+		return nil
+	}, durable, Workers(1), WorkerAckMode(OnDispatch)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first message occupies the worker, the others wait for it
+	for _, body := range []string{"first", "second", "third"} {
+		if err := b.Publish("test", &broker.Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-started
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	b = newTestBroker(t, addr, ClientID("buffered"))
+	defer b.Disconnect()
+	ch := make(chan string, 3)
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		ch <- string(e.Message().Body)
+		return nil
+	}, durable); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]bool{receive(t, ch): true, receive(t, ch): true}
+	if !got["second"] || !got["third"] {
+		t.Errorf("Expected the buffered messages to be redelivered, got %v", got)
+	}
+}
+
+func TestDrainQueueGroupWaitsForWorkers(t *testing.T) {
+	addr, shutdown := runServer(t)
+	defer shutdown()
+
+	b := newTestBroker(t, addr)
+	defer b.Disconnect()
+
+	var started, finished int32
+	if _, err := b.Subscribe("test", func(e broker.Event) error {
+		atomic.AddInt32(&started, 1)
+		time.Sleep(300 * time.Millisecond)
+		atomic.AddInt32(&finished, 1)
+		return nil
+	}, broker.Queue("workers"), Workers(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := b.Publish("test", &broker.Message{Body: []byte("job")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&started) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := b.DrainQueueGroup(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if f := atomic.LoadInt32(&finished); f != 2 {
+		t.Errorf("Expected the drain to wait for both workers, %d finished", f)
+	}
+}